@@ -20,6 +20,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -27,8 +28,11 @@ import (
 )
 
 var (
-	endpoint string
-	nodeID   string
+	endpoint       string
+	nodeID         string
+	gcInterval     time.Duration
+	gcDryRun       bool
+	metricsAddress string
 )
 
 func init() {
@@ -55,6 +59,10 @@ func main() {
 	cmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "CSI endpoint")
 	cmd.MarkPersistentFlagRequired("endpoint")
 
+	cmd.PersistentFlags().DurationVar(&gcInterval, "gc-interval", 0, "interval of the garbage collector of deleted volumes, 0 disables it")
+	cmd.PersistentFlags().BoolVar(&gcDryRun, "gc-dry-run", true, "only report what the garbage collector would remove")
+	cmd.PersistentFlags().StringVar(&metricsAddress, "metrics-address", "", "address to serve metrics on")
+
 	cmd.ParseFlags(os.Args[1:])
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "%s", err.Error())
@@ -66,5 +74,9 @@ func main() {
 
 func handle() {
 	d := vstorage.NewDriver(nodeID, endpoint)
+	d.EnableGC(gcInterval, gcDryRun)
+	if metricsAddress != "" {
+		d.ServeMetrics(metricsAddress)
+	}
 	d.Run()
 }
@@ -1,6 +1,6 @@
 #!/bin/sh
 
-VERSION="v0.1.0-2"
+VERSION="v5.2.0"
 SANITYTGZ="csi-sanity-${VERSION}.linux.amd64.tar.gz"
 
 if [ ! -x $GOPATH/bin/csi-sanity ] ; then
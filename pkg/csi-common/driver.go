@@ -22,7 +22,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 )
 
 type CSIDriver struct {
@@ -30,6 +30,8 @@ type CSIDriver struct {
 	nodeID  string
 	version string
 	cap     []*csi.ControllerServiceCapability
+	nscap   []*csi.NodeServiceCapability
+	pcap    []*csi.PluginCapability
 	vc      []*csi.VolumeCapability_AccessMode
 }
 
@@ -86,6 +88,37 @@ func (d *CSIDriver) AddControllerServiceCapabilities(cl []csi.ControllerServiceC
 	return
 }
 
+func (d *CSIDriver) AddNodeServiceCapabilities(nl []csi.NodeServiceCapability_RPC_Type) {
+	var nsc []*csi.NodeServiceCapability
+
+	for _, n := range nl {
+		glog.Infof("Enabling node service capability: %v", n.String())
+		nsc = append(nsc, NewNodeServiceCapability(n))
+	}
+
+	d.nscap = nsc
+
+	return
+}
+
+func (d *CSIDriver) AddPluginServiceCapabilities(pl []csi.PluginCapability_Service_Type) {
+	for _, p := range pl {
+		glog.Infof("Enabling plugin service capability: %v", p.String())
+		d.pcap = append(d.pcap, NewPluginServiceCapability(p))
+	}
+
+	return
+}
+
+func (d *CSIDriver) AddPluginVolumeExpansionCapabilities(pl []csi.PluginCapability_VolumeExpansion_Type) {
+	for _, p := range pl {
+		glog.Infof("Enabling plugin volume expansion capability: %v", p.String())
+		d.pcap = append(d.pcap, NewPluginVolumeExpansionCapability(p))
+	}
+
+	return
+}
+
 func (d *CSIDriver) AddVolumeCapabilityAccessModes(vc []csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability_AccessMode {
 	var vca []*csi.VolumeCapability_AccessMode
 	for _, c := range vc {
@@ -99,3 +132,7 @@ func (d *CSIDriver) AddVolumeCapabilityAccessModes(vc []csi.VolumeCapability_Acc
 func (d *CSIDriver) GetVolumeCapabilityAccessModes() []*csi.VolumeCapability_AccessMode {
 	return d.vc
 }
+
+func (d *CSIDriver) GetNodeID() string {
+	return d.nodeID
+}
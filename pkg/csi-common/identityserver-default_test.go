@@ -20,7 +20,7 @@ import (
 	"context"
 	"testing"
 
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,3 +35,30 @@ func TestGetPluginInfo(t *testing.T) {
 	assert.Equal(t, resp.GetName(), fakeDriverName)
 	assert.Equal(t, resp.GetVendorVersion(), vendorVersion)
 }
+
+func TestGetPluginCapabilities(t *testing.T) {
+	d := NewFakeDriver()
+
+	ids := NewDefaultIdentityServer(d)
+
+	d.AddPluginServiceCapabilities([]csi.PluginCapability_Service_Type{csi.PluginCapability_Service_CONTROLLER_SERVICE})
+	d.AddPluginVolumeExpansionCapabilities([]csi.PluginCapability_VolumeExpansion_Type{csi.PluginCapability_VolumeExpansion_ONLINE})
+
+	req := csi.GetPluginCapabilitiesRequest{}
+	resp, err := ids.GetPluginCapabilities(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(resp.GetCapabilities()))
+	assert.Equal(t, csi.PluginCapability_Service_CONTROLLER_SERVICE, resp.GetCapabilities()[0].GetService().GetType())
+	assert.Equal(t, csi.PluginCapability_VolumeExpansion_ONLINE, resp.GetCapabilities()[1].GetVolumeExpansion().GetType())
+}
+
+func TestProbe(t *testing.T) {
+	d := NewFakeDriver()
+
+	ids := NewDefaultIdentityServer(d)
+
+	req := csi.ProbeRequest{}
+	resp, err := ids.Probe(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.True(t, resp.GetReady().GetValue())
+}
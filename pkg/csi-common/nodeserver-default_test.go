@@ -20,20 +20,20 @@ import (
 	"context"
 	"testing"
 
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-func TestNodeGetId(t *testing.T) {
+func TestNodeGetInfo(t *testing.T) {
 	d := NewFakeDriver()
 
 	ns := NewDefaultNodeServer(d)
 
 	// Test valid request
-	req := csi.NodeGetIdRequest{}
-	resp, err := ns.NodeGetId(context.Background(), &req)
+	req := csi.NodeGetInfoRequest{}
+	resp, err := ns.NodeGetInfo(context.Background(), &req)
 	assert.NoError(t, err)
 	assert.Equal(t, resp.GetNodeId(), fakeNodeID)
 }
@@ -45,8 +45,16 @@ func TestNodeGetCapabilities(t *testing.T) {
 
 	// Test valid request
 	req := csi.NodeGetCapabilitiesRequest{}
-	_, err := ns.NodeGetCapabilities(context.Background(), &req)
+	resp, err := ns.NodeGetCapabilities(context.Background(), &req)
 	assert.NoError(t, err)
+	assert.Zero(t, len(resp.GetCapabilities()))
+
+	// Test driver with node capabilities
+	d.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME})
+	resp, err = ns.NodeGetCapabilities(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(resp.GetCapabilities()))
+	assert.Equal(t, csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME, resp.GetCapabilities()[0].GetRpc().GetType())
 }
 
 func TestNodePublishVolume(t *testing.T) {
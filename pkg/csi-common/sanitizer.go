@@ -0,0 +1,105 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// secretPlaceholder replaces values of secrets in logs
+const secretPlaceholder = "***stripped***"
+
+// StripSecrets returns a copy of a CSI message where values of all fields
+// marked with the csi_secret option are replaced with a placeholder, so the
+// message can be logged. Other values are returned as is.
+func StripSecrets(msg interface{}) interface{} {
+	m, ok := msg.(proto.Message)
+	if !ok || m == nil {
+		return msg
+	}
+	c := proto.Clone(m)
+	if c == nil {
+		return msg
+	}
+	stripMessage(c.ProtoReflect())
+	return c
+}
+
+func isSecret(fd protoreflect.FieldDescriptor) bool {
+	opts := fd.Options()
+	if opts == nil {
+		return false
+	}
+	secret, _ := proto.GetExtension(opts, csi.E_CsiSecret).(bool)
+	return secret
+}
+
+func stripMessage(m protoreflect.Message) {
+	if !m.IsValid() {
+		return
+	}
+
+	// message fields are changed only when the iteration is over
+	secrets := []protoreflect.FieldDescriptor{}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case isSecret(fd):
+			secrets = append(secrets, fd)
+		case fd.IsList() && fd.Message() != nil:
+			l := v.List()
+			for i := 0; i < l.Len(); i++ {
+				stripMessage(l.Get(i).Message())
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+				stripMessage(mv.Message())
+				return true
+			})
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil:
+			stripMessage(v.Message())
+		}
+		return true
+	})
+
+	for _, fd := range secrets {
+		stripField(m, fd)
+	}
+}
+
+// stripField replaces a secret value. Secrets in CSI are string maps, but
+// plain strings are handled too in case they appear in later versions.
+func stripField(m protoreflect.Message, fd protoreflect.FieldDescriptor) {
+	placeholder := protoreflect.ValueOfString(secretPlaceholder)
+	switch {
+	case fd.IsMap() && fd.MapValue().Kind() == protoreflect.StringKind:
+		mv := m.Mutable(fd).Map()
+		keys := []protoreflect.MapKey{}
+		mv.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+			keys = append(keys, k)
+			return true
+		})
+		for _, k := range keys {
+			mv.Set(k, placeholder)
+		}
+	case !fd.IsList() && !fd.IsMap() && fd.Kind() == protoreflect.StringKind:
+		m.Set(fd, placeholder)
+	default:
+		m.Clear(fd)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+const fakePassword = "fakePassword"
+
+func fakeSecrets() map[string]string {
+	return map[string]string{
+		"clusterName":     "fakeCluster",
+		"clusterPassword": fakePassword,
+	}
+}
+
+func TestStripSecrets(t *testing.T) {
+	for _, req := range []proto.Message{
+		&csi.CreateVolumeRequest{Name: "fakeName", Secrets: fakeSecrets()},
+		&csi.DeleteVolumeRequest{VolumeId: "fakeVolumeID", Secrets: fakeSecrets()},
+		&csi.ControllerPublishVolumeRequest{VolumeId: "fakeVolumeID", Secrets: fakeSecrets()},
+		&csi.ControllerUnpublishVolumeRequest{VolumeId: "fakeVolumeID", Secrets: fakeSecrets()},
+		&csi.ValidateVolumeCapabilitiesRequest{VolumeId: "fakeVolumeID", Secrets: fakeSecrets()},
+		&csi.CreateSnapshotRequest{Name: "fakeName", Secrets: fakeSecrets()},
+		&csi.DeleteSnapshotRequest{SnapshotId: "fakeSnapshotID", Secrets: fakeSecrets()},
+		&csi.ListSnapshotsRequest{SnapshotId: "fakeSnapshotID", Secrets: fakeSecrets()},
+		&csi.ControllerExpandVolumeRequest{VolumeId: "fakeVolumeID", Secrets: fakeSecrets()},
+		&csi.NodeStageVolumeRequest{VolumeId: "fakeVolumeID", Secrets: fakeSecrets()},
+		&csi.NodePublishVolumeRequest{VolumeId: "fakeVolumeID", Secrets: fakeSecrets()},
+		&csi.NodeExpandVolumeRequest{VolumeId: "fakeVolumeID", Secrets: fakeSecrets()},
+	} {
+		name := string(req.ProtoReflect().Descriptor().Name())
+		s := fmt.Sprintf("%+v", StripSecrets(req))
+
+		assert.NotContains(t, s, fakePassword, name)
+		assert.Contains(t, s, secretPlaceholder, name)
+		// keys are kept to see which secrets are passed
+		assert.Contains(t, s, "clusterPassword", name)
+
+		// the request itself isn't changed
+		assert.Contains(t, fmt.Sprintf("%+v", req), fakePassword, name)
+	}
+}
+
+func TestStripSecretsKeepsOtherFields(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:       "fakeName",
+		Parameters: map[string]string{"vzsTier": "1"},
+		Secrets:    fakeSecrets(),
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+				},
+			},
+		},
+	}
+
+	stripped, ok := StripSecrets(req).(*csi.CreateVolumeRequest)
+	assert.True(t, ok)
+	assert.Equal(t, "fakeName", stripped.GetName())
+	assert.Equal(t, req.GetParameters(), stripped.GetParameters())
+	assert.Equal(t, "ext4", stripped.GetVolumeCapabilities()[0].GetMount().GetFsType())
+	assert.Equal(t, secretPlaceholder, stripped.GetSecrets()["clusterPassword"])
+	assert.Equal(t, fakePassword, req.GetSecrets()["clusterPassword"])
+}
+
+func TestStripSecretsNoMessage(t *testing.T) {
+	assert.Nil(t, StripSecrets(nil))
+	assert.Equal(t, "fake", StripSecrets("fake"))
+
+	var req *csi.CreateVolumeRequest
+	assert.NotPanics(t, func() { StripSecrets(req) })
+
+	resp := &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "fakeVolumeID"}}
+	assert.True(t, proto.Equal(resp, StripSecrets(resp).(proto.Message)))
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// VolumeLocks serialises operations on volumes and snapshots. An operation
+// doesn't wait for a busy ID, it fails with Aborted and a CO retries it
+// later.
+type VolumeLocks struct {
+	mux   sync.Mutex
+	locks map[string]struct{}
+}
+
+func NewVolumeLocks() *VolumeLocks {
+	return &VolumeLocks{
+		locks: map[string]struct{}{},
+	}
+}
+
+// TryAcquire locks all ids or none of them and reports whether it has
+// succeeded. Empty ids are ignored.
+func (vl *VolumeLocks) TryAcquire(ids ...string) bool {
+	vl.mux.Lock()
+	defer vl.mux.Unlock()
+
+	for _, id := range ids {
+		if _, ok := vl.locks[id]; ok {
+			return false
+		}
+	}
+	for _, id := range ids {
+		if id != "" {
+			vl.locks[id] = struct{}{}
+		}
+	}
+	return true
+}
+
+func (vl *VolumeLocks) Release(ids ...string) {
+	vl.mux.Lock()
+	defer vl.mux.Unlock()
+
+	for _, id := range ids {
+		delete(vl.locks, id)
+	}
+}
+
+// Lock acquires ids and returns a function to release them. If one of ids
+// is busy, an Aborted error is returned.
+func (vl *VolumeLocks) Lock(ids ...string) (func(), error) {
+	if !vl.TryAcquire(ids...) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf("%s: operation pending", strings.Join(ids, ", ")))
+	}
+	return func() { vl.Release(ids...) }, nil
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	vl := NewVolumeLocks()
+
+	assert.True(t, vl.TryAcquire("vol1"))
+	assert.False(t, vl.TryAcquire("vol1"))
+	assert.True(t, vl.TryAcquire("vol2"))
+
+	// nothing is locked if one of ids is busy
+	assert.False(t, vl.TryAcquire("vol3", "vol1"))
+	assert.True(t, vl.TryAcquire("vol3"))
+
+	vl.Release("vol1")
+	assert.True(t, vl.TryAcquire("vol1"))
+
+	// empty ids aren't locked
+	assert.True(t, vl.TryAcquire("vol4", ""))
+	assert.True(t, vl.TryAcquire(""))
+}
+
+func TestVolumeLocksLock(t *testing.T) {
+	vl := NewVolumeLocks()
+
+	unlock, err := vl.Lock("vol1", "snap1")
+	assert.NoError(t, err)
+
+	_, err = vl.Lock("snap1")
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Contains(t, err.Error(), "operation pending")
+
+	unlock()
+	unlock, err = vl.Lock("snap1")
+	assert.NoError(t, err)
+	unlock()
+}
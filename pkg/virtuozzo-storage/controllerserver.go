@@ -17,6 +17,8 @@ limitations under the License.
 package vstorage
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
@@ -24,16 +26,20 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/golang/glog"
-	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"github.com/avagin/csi-vstorage/pkg/csi-common"
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/avagin/csi-vstorage/pkg/virtuozzo-storage/vstorage"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kolyshkin/goploop-cli"
-	"github.com/pborman/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
@@ -44,24 +50,75 @@ const (
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+	volumeLocks *csicommon.VolumeLocks
+	clusters    *vstorage.MountManager
+	dirs        *volumeDirs
 }
 
 const provisionerDir = "/export/virtuozzo-provisioner/"
 const mountDir = provisionerDir + "mnt/"
 
-func createPloop(volumeID, mount string, secret map[string]string, options map[string]string, bytes uint64) error {
-	var (
-		volumePath, deltasPath string
-	)
+// Snapshots of a volume live in the <volumeID>.snapshots directory next to
+// the volume itself, a snapshot ID is <volumeID>@<snapshotName>.
+const (
+	snapshotsSuffix = ".snapshots"
+	snapshotIDSep   = "@"
+)
+
+// Transient snapshots which are used to clone volumes are hidden from
+// ListSnapshots.
+const cloneSnapshotPrefix = ".clone-"
+
+// Images of a volume are kept in the <volumeID>.image directory. A volume
+// is built in the <volumeID>.creating directory and renamed to <volumeID>
+// when it is ready, so a volume directory always contains a complete ploop
+// volume. A volume is renamed to <volumeID>.deleted before it is removed.
+// Nodes which have staged a volume are listed in <volumeID>.staged.
+const (
+	imageSuffix    = ".image"
+	creatingSuffix = ".creating"
+	deletedSuffix  = ".deleted"
+	stagedSuffix   = ".staged"
+)
+
+// ploop-volume creates ext4 and ploop can mount only ext4, so it's the only
+// file system of volumes
+const defaultFsType = "ext4"
+
+func isSupportedFsType(fsType string) bool {
+	return fsType == "" || fsType == defaultFsType
+}
 
-	for k, v := range secret {
+// setPloopAttributes applies vstorage attributes from storage class
+// parameters to a directory with ploop metadata or images.
+func setPloopAttributes(dir string, options map[string]string) error {
+	for k, v := range options {
+		attr := ""
 		switch k {
-		case "volumePath":
-			volumePath = v
-		case "deltasPath":
-			deltasPath = v
+		case "vzsReplicas":
+			attr = "replicas"
+		case "vzsTier":
+			attr = "tier"
+		case "vzsEncoding":
+			attr = "encoding"
+		case "vzsFailureDomain":
+			attr = "failure-domain"
+		}
+		if attr == "" {
+			continue
+		}
+
+		cmd := "vstorage"
+		args := []string{"set-attr", "-R", dir,
+			fmt.Sprintf("%s=%s", attr, v)}
+		if err := exec.Command(cmd, args...).Run(); err != nil {
+			return fmt.Errorf("Unable to set %s to %s for %s: %v", attr, v, dir, err)
 		}
 	}
+	return nil
+}
+
+func createPloop(id *volumeID, mount string, options map[string]string, bytes uint64) error {
 	for k, v := range options {
 		switch k {
 		case "vzsReplicas":
@@ -70,32 +127,28 @@ func createPloop(volumeID, mount string, secret map[string]string, options map[s
 		case "vzsTier":
 		case "kubernetes.io/readwrite":
 		case "kubernetes.io/fsType":
+		case clusterNameKey:
 		default:
 			glog.Errorf("Unknown parameter: %v = %v", k, v)
 		}
 	}
 
-	if volumePath == "" {
+	if id.volumePath == "" {
 		return fmt.Errorf("volumePath isn't specified")
 	}
 
-	if deltasPath == "" {
-		deltasPath = volumePath
-	}
-
-	if volumeID == "" {
+	if id.name == "" {
 		return fmt.Errorf("volumeID isn't specified")
 	}
 
 	// ploop driver takes kilobytes, so convert it
 	volumeSize := bytes / 1024
 
-	volumeDir := path.Join(mount, volumePath)
-	ploopPath := path.Join(volumeDir, volumeID)
+	ploopPath := id.ploopPath(mount)
+	volumeDir := path.Dir(ploopPath)
 
-	deltaDir := path.Join(mount, deltasPath)
-	// add .image suffix to handle case when deltasPath == volumePath
-	imageDir := path.Join(deltaDir, volumeID+".image")
+	imageDir := id.imageDir(mount)
+	deltaDir := path.Dir(imageDir)
 	imageFile := path.Join(imageDir, "root.hds")
 
 	if err := os.MkdirAll(volumeDir, 0755); err != nil {
@@ -106,242 +159,1174 @@ func createPloop(volumeID, mount string, secret map[string]string, options map[s
 		return fmt.Errorf("Error creating dir %s: %v", deltaDir, err)
 	}
 
-	// create base dirs for ploop metadatas and ploop images
-	if err := os.Mkdir(ploopPath, 0755); err != nil {
-		return fmt.Errorf("Error creating dir %s: %v", ploopPath, err)
+	if err := rollbackPloop(id, mount); err != nil {
+		return err
+	}
+
+	// create base dirs for ploop metadatas and ploop images, the metadata
+	// dir is created first to mark the images as a part of the new volume
+	tmpPath := ploopPath + creatingSuffix
+	if err := os.Mkdir(tmpPath, 0755); err != nil {
+		return fmt.Errorf("Error creating dir %s: %v", tmpPath, err)
 	}
 
+	// images which already exist aren't marked by the temporary directory,
+	// they may belong to someone else
 	if err := os.Mkdir(imageDir, 0755); err != nil {
-		os.Remove(ploopPath)
+		os.Remove(tmpPath)
 		return fmt.Errorf("Error creating dir %s: %v", imageDir, err)
 	}
 
-	for _, d := range []string{ploopPath, imageDir} {
-		for k, v := range options {
-			attr := ""
-			switch k {
-			case "vzsReplicas":
-				attr = "replicas"
-			case "vzsTier":
-				attr = "tier"
-			case "vzsEncoding":
-				attr = "encoding"
-			case "vzsFailureDomain":
-				attr = "failure-domain"
-			}
-			if attr == "" {
-				continue
+	err := func() error {
+		for _, d := range []string{tmpPath, imageDir} {
+			if err := setPloopAttributes(d, options); err != nil {
+				return err
 			}
+		}
 
-			cmd := "vstorage"
-			args := []string{"set-attr", "-R", d,
-				fmt.Sprintf("%s=%s", attr, v)}
-			if err := exec.Command(cmd, args...).Run(); err != nil {
-				os.Remove(ploopPath)
-				os.Remove(imageDir)
-				return fmt.Errorf("Unable to set %s to %s for %s: %v", attr, v, d, err)
-			}
+		// Create the ploop volume
+		if _, err := ploop.PloopVolumeCreate(tmpPath, volumeSize, imageFile); err != nil {
+			return err
+		}
+
+		return os.Rename(tmpPath, ploopPath)
+	}()
+	if err != nil {
+		if err := rollbackPloop(id, mount); err != nil {
+			glog.Errorf("Unable to roll back %s: %v", ploopPath, err)
 		}
+		return err
 	}
 
-	// Create the ploop volume
-	_, err := ploop.PloopVolumeCreate(ploopPath, volumeSize, imageFile)
+	return nil
+}
+
+// rollbackPloop removes leftovers of an interrupted creation of a volume: a
+// temporary ploop directory with its images. Only <volumeID>.creating is
+// made by the driver, so a volume directory without DiskDescriptor.xml
+// isn't ours and FailedPrecondition is returned for it without touching
+// anything. Nothing is done if there are no leftovers, so images of other
+// volumes are never touched.
+func rollbackPloop(id *volumeID, mount string) error {
+	ploopPath := id.ploopPath(mount)
+	tmpPath := ploopPath + creatingSuffix
+	imageDir := id.imageDir(mount)
+
+	foreign, err := isForeign(ploopPath)
 	if err != nil {
-		os.RemoveAll(ploopPath)
-		os.RemoveAll(imageDir)
 		return err
 	}
+	if foreign {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("%s exists and isn't a ploop volume", ploopPath))
+	}
+	// images of a complete volume are kept
+	_, err = os.Stat(ploopPath)
+	complete := err == nil
+
+	if _, err := os.Stat(tmpPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	glog.Infof("Roll back: %s", tmpPath)
+	if vol, err := ploop.PloopVolumeOpen(tmpPath); err == nil {
+		if err := vol.Delete(); err != nil {
+			glog.Errorf("Unable to delete %s: %v", tmpPath, err)
+		}
+	}
+
+	// images are removed first, the leftover directory marks them as ours
+	// until they are gone
+	if !complete {
+		if err := os.RemoveAll(imageDir); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(tmpPath)
+}
+
+// isForeign returns true if something which isn't a ploop volume is found
+// in the directory of a volume. The driver never makes such directories, so
+// they belong to someone else and are never touched.
+func isForeign(ploopPath string) (bool, error) {
+	if _, err := os.Lstat(ploopPath); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	_, err := os.Stat(filepath.Join(ploopPath, "DiskDescriptor.xml"))
+	if err == nil {
+		return false, nil
+	}
+	if os.IsNotExist(err) || errno(err) == syscall.ENOTDIR {
+		return true, nil
+	}
+	return false, err
+}
 
+// checkCloneFsType makes sure that the file system type which is requested
+// for a clone is the one of its source, a clone can't be formatted again.
+func checkCloneFsType(options map[string]string) error {
+	if fsType := options["kubernetes.io/fsType"]; !isSupportedFsType(fsType) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("File system type %s differs from %s of the source", fsType, defaultFsType))
+	}
 	return nil
 }
 
-func removePloop(volumeID, mount string, options map[string]string) error {
-	volumePath := options["volumePath"]
-	deltasPath, ok := options["deltasPath"]
-	if !ok {
-		deltasPath = volumePath
+// clonePloop creates a new ploop volume from a snapshot and enlarges it up to
+// bytes if the snapshot is smaller.
+func clonePloop(id *volumeID, mount string, options map[string]string, snapshotPath string, bytes uint64) error {
+	if id.volumePath == "" {
+		return fmt.Errorf("volumePath isn't specified")
+	}
+
+	if id.name == "" {
+		return fmt.Errorf("volumeID isn't specified")
+	}
+
+	if err := checkCloneFsType(options); err != nil {
+		return err
 	}
-	imageDir := path.Join(mount, deltasPath, volumeID+".image")
-	ploopPath := path.Join(mount, options["volumePath"], volumeID)
-	ploopPathTmp := path.Join(mount, options["volumePath"], volumeID+".deleted")
-	err := os.Rename(ploopPath, ploopPathTmp)
+
+	ploopPath := id.ploopPath(mount)
+	volumeDir := path.Dir(ploopPath)
+
+	snap, err := ploop.PloopVolumeSnapshotOpen(snapshotPath)
 	if err != nil {
 		return err
 	}
 
-	cmd := "vstorage"
-	args := []string{"revoke", "-R", imageDir}
-	err = exec.Command(cmd, args...).Run()
+	snapSize, err := getPloopCapacity(snapshotPath)
 	if err != nil {
-		glog.Errorf("Unable to revoke a lease for %s", imageDir)
+		return err
 	}
 
-	vol, err := ploop.PloopVolumeOpen(ploopPathTmp)
+	if err := os.MkdirAll(volumeDir, 0755); err != nil {
+		return fmt.Errorf("Error creating dir %s: %v", volumeDir, err)
+	}
+
+	if err := rollbackPloop(id, mount); err != nil {
+		return err
+	}
+
+	tmpPath := ploopPath + creatingSuffix
+	if err := os.Mkdir(tmpPath, 0755); err != nil {
+		return fmt.Errorf("Error creating dir %s: %v", tmpPath, err)
+	}
+
+	err = func() error {
+		if err := setPloopAttributes(tmpPath, options); err != nil {
+			return err
+		}
+
+		glog.Infof("Clone: %s -> %s", snapshotPath, ploopPath)
+		if _, err := snap.Clone(tmpPath); err != nil {
+			return err
+		}
+		if err := checkCloneImages(tmpPath, id.imageDir(mount)); err != nil {
+			return err
+		}
+
+		if bytes > snapSize {
+			p, err := ploop.Open(path.Join(tmpPath, "DiskDescriptor.xml"))
+			if err != nil {
+				return err
+			}
+			// ploop driver takes kilobytes, so convert it
+			err = p.Resize(bytes/1024, true)
+			p.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		return os.Rename(tmpPath, ploopPath)
+	}()
 	if err != nil {
+		if err := rollbackPloop(id, mount); err != nil {
+			glog.Errorf("Unable to roll back %s: %v", ploopPath, err)
+		}
 		return err
 	}
-	glog.Infof("Delete: %s", ploopPathTmp)
-	err = vol.Delete()
+
+	return nil
+}
+
+// checkCloneImages makes sure that a clone in ploopPath uses only its own
+// images, which are kept in imageDir or next to its DiskDescriptor.xml. A
+// clone which uses images of its source would be broken when the source is
+// deleted.
+func checkCloneImages(ploopPath, imageDir string) error {
+	files, err := ploopImages(ploopPath)
 	if err != nil {
 		return err
 	}
-	os.RemoveAll(imageDir)
+	for _, f := range files {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(ploopPath, f)
+		}
+		if !isInside(f, imageDir) && !isInside(f, ploopPath) {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("Clone %s uses %s of another volume", ploopPath, f))
+		}
+	}
 	return nil
 }
 
-type DiskParameters struct {
-	DiskSize uint64 `xml:"Disk_size"`
+// isInside reports whether a path p is inside a directory dir
+func isInside(p, dir string) bool {
+	return strings.HasPrefix(filepath.Clean(p), filepath.Clean(dir)+"/")
 }
 
-type ParallelsDiskImage struct {
-	DiskParameters DiskParameters `xml:"Disk_Parameters"`
+// clonePloopVolume creates a new independent ploop volume from an existing
+// one. ploop-volume can only clone snapshots, so a transient snapshot of the
+// source volume is taken and removed when the clone is done, even if it
+// failed.
+func clonePloopVolume(src, vol *volumeID, mount string, options map[string]string, bytes uint64) error {
+	if err := checkCloneFsType(options); err != nil {
+		return err
+	}
+
+	name := cloneSnapshotPrefix + vol.name
+	snapshotPath := path.Join(src.snapshotsDir(mount), name)
+
+	// a leftover of an interrupted clone
+	if _, err := os.Stat(snapshotPath); err == nil {
+		if err := removeSnapshot(snapshotPath); err != nil {
+			return err
+		}
+	}
+
+	if err := createSnapshot(src, name, mount); err != nil {
+		return err
+	}
+	defer func() {
+		if err := removeSnapshot(snapshotPath); err != nil {
+			glog.Errorf("Unable to remove transient snapshot %s: %v", snapshotPath, err)
+		}
+	}()
+
+	return clonePloop(vol, mount, options, snapshotPath, bytes)
 }
 
-func getPloopCapacity(ploopPath string) (uint64, error) {
-	data, err := ioutil.ReadFile(filepath.Join(ploopPath, "DiskDescriptor.xml"))
+// checkPloopUnused returns FailedPrecondition if a volume is staged on some
+// node or has snapshots. Snapshots which are left by interrupted clones
+// don't count, they are removed with the volume.
+func checkPloopUnused(id *volumeID, mount string) error {
+	nodes, err := stagedNodes(id.ploopPath(mount))
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if len(nodes) != 0 {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Volume %s is staged on %s", id.name, strings.Join(nodes, ", ")))
 	}
 
-	v := ParallelsDiskImage{}
-	err = xml.Unmarshal([]byte(data), &v)
-	if err != nil {
-		return 0, err
+	entries, err := ioutil.ReadDir(id.snapshotsDir(mount))
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	return v.DiskParameters.DiskSize * 512, nil
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), cloneSnapshotPrefix) {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("Volume %s has snapshots", id.name))
+		}
+	}
+	return nil
 }
 
-func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		glog.V(3).Infof("invalid create volume req: %v", req)
-		return nil, err
+// removePloop deletes a volume with its images. dirs are volumePath
+// directories where volumes which can use the images are looked for.
+func removePloop(id *volumeID, mount string, dirs []string) error {
+	// snapshots which are left by interrupted clones
+	snapshotsDir := id.snapshotsDir(mount)
+	entries, err := ioutil.ReadDir(snapshotsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		if err := removeSnapshot(filepath.Join(snapshotsDir, e.Name())); err != nil {
+			return err
+		}
 	}
 
-	// Check arguments
-	if len(req.GetName()) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	ploopPath := id.ploopPath(mount)
+	if err := checkImagesUnused(dirs, id.imageDir(mount), ploopPath); err != nil {
+		return err
 	}
-	if req.GetVolumeCapabilities() == nil {
-		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
+
+	ploopPathTmp := ploopPath + deletedSuffix
+	err = os.Rename(ploopPath, ploopPathTmp)
+	if err != nil {
+		return err
 	}
 
-	// Volume Name
-	volName := req.GetName()
-	if len(volName) == 0 {
-		volName = uuid.NewUUID().String()
+	return removeDeletedPloop(ploopPathTmp, id.imageDir(mount), dirs)
+}
+
+// removePloopRemnants finishes a deletion or a creation of a volume which
+// has been interrupted. It's called when the volume directory is gone. Only
+// entries which the driver makes are removed: <volumeID>.creating,
+// <volumeID>.deleted and <volumeID>.staged. Images without any of them
+// can't be told from images of someone else, so they are left for the
+// garbage collector.
+func removePloopRemnants(id *volumeID, mount string, dirs []string) error {
+	if err := rollbackPloop(id, mount); err != nil {
+		return err
 	}
 
-	// Volume Size - Default is 1 GiB
-	volSizeBytes := uint64(1 * 1024 * 1024 * 1024)
-	if req.GetCapacityRange() != nil {
-		volSizeBytes = uint64(req.GetCapacityRange().GetRequiredBytes())
+	ploopPath := id.ploopPath(mount)
+	ploopPathTmp := ploopPath + deletedSuffix
+	if _, err := os.Stat(ploopPathTmp); err == nil {
+		if err := removeDeletedPloop(ploopPathTmp, id.imageDir(mount), dirs); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
 	}
 
-	storageClassOptions := map[string]string{}
+	return os.RemoveAll(ploopPath + stagedSuffix)
+}
 
-	for k, v := range req.GetParameters() {
-		storageClassOptions[k] = v
+// removeDeletedPloop removes a volume which has been renamed to
+// <volumeID>.deleted. It is also used to finish interrupted deletions. If
+// DiskDescriptor.xml is already gone, the images of the volume can't be
+// found reliably, so they are left for the garbage collector. Images which
+// are used by other volumes or snapshots in dirs are never removed.
+func removeDeletedPloop(ploopPathTmp, imageDir string, dirs []string) error {
+	if _, err := os.Stat(filepath.Join(ploopPathTmp, "DiskDescriptor.xml")); os.IsNotExist(err) {
+		glog.Infof("Delete: %s", ploopPathTmp)
+		return os.RemoveAll(ploopPathTmp)
 	}
-	storageClassOptions["size"] = fmt.Sprintf("%d", volSizeBytes)
 
-	secret := req.GetControllerCreateSecrets()
-	cluster := secret["clusterName"]
-	password := secret["clusterPassword"]
+	if err := checkImagesUnused(dirs, imageDir, ploopPathTmp); err != nil {
+		return err
+	}
 
-	mount := filepath.Join(workingDir, cluster)
-	if err := prepareVstorage(cluster, password, mount); err != nil {
-		return nil, err
+	cmd := "vstorage"
+	args := []string{"revoke", "-R", imageDir}
+	err := exec.Command(cmd, args...).Run()
+	if err != nil {
+		glog.Errorf("Unable to revoke a lease for %s", imageDir)
 	}
 
-	volumeDir := path.Join(mount, secret["volumePath"])
-	ploopPath := path.Join(volumeDir, volName)
+	vol, err := ploop.PloopVolumeOpen(ploopPathTmp)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Delete: %s", ploopPathTmp)
+	err = vol.Delete()
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(imageDir)
+	return os.RemoveAll(ploopPathTmp)
+}
 
-	_, err := os.Stat(ploopPath)
-	if err == nil {
-		capacity, err := getPloopCapacity(ploopPath)
+// checkImagesUnused returns FailedPrecondition if images in imageDir are
+// used by a volume or a snapshot in volumePath directories dirs other than
+// the volume in ploopPath.
+func checkImagesUnused(dirs []string, imageDir, ploopPath string) error {
+	users := []string{}
+	check := func(p string) error {
+		files, err := ploopImages(p)
 		if err != nil {
-			return nil, err
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
 		}
-		if capacity >= volSizeBytes {
-			return &csi.CreateVolumeResponse{
-				Volume: &csi.Volume{
-					Id:            volName,
-					Attributes:    storageClassOptions,
-					CapacityBytes: int64(volSizeBytes),
-				},
-			}, nil
-		} else {
-			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different size already exist", req.GetName()))
+		for _, f := range files {
+			if !filepath.IsAbs(f) {
+				f = filepath.Join(p, f)
+			}
+			if isInside(f, imageDir) {
+				users = append(users, p)
+				break
+			}
 		}
+		return nil
 	}
-	if err != nil && !os.IsNotExist(err) {
-		return nil, err
+
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			if !e.IsDir() || p == filepath.Clean(ploopPath) || strings.HasSuffix(e.Name(), imageSuffix) {
+				continue
+			}
+			if !strings.HasSuffix(e.Name(), snapshotsSuffix) {
+				if err := check(p); err != nil {
+					return err
+				}
+				continue
+			}
+			snapshots, err := ioutil.ReadDir(p)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, snap := range snapshots {
+				if err := check(filepath.Join(p, snap.Name())); err != nil {
+					return err
+				}
+			}
+		}
 	}
 
-	if err := createPloop(volName, mount, secret, storageClassOptions, volSizeBytes); err != nil {
-		return nil, err
+	if len(users) != 0 {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Images %s are used by %s", imageDir, strings.Join(users, ", ")))
 	}
+	return nil
+}
 
-	return &csi.CreateVolumeResponse{
-		Volume: &csi.Volume{
-			Id:            volName,
-			Attributes:    storageClassOptions,
-			CapacityBytes: int64(volSizeBytes),
-		},
-	}, nil
+func makeSnapshotID(vol *volumeID, name string) string {
+	return vol.String() + snapshotIDSep + name
 }
 
-func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	// Check arguments
-	if len(req.GetVolumeId()) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+// parseSnapshotID splits a snapshot ID into the source volume and the
+// snapshot name. Volume IDs from secret are completed and errors are
+// reported as in parseVolumeID.
+func parseSnapshotID(snapshotID string, secret map[string]string) (*volumeID, string, error) {
+	i := strings.LastIndex(snapshotID, snapshotIDSep)
+	if i <= 0 || i == len(snapshotID)-1 {
+		return nil, "", status.Error(codes.NotFound, fmt.Sprintf("Malformed snapshot ID: %s", snapshotID))
 	}
-
-	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		glog.V(3).Infof("invalid delete volume req: %v", req)
-		return nil, err
+	vol, err := parseVolumeID(snapshotID[:i], secret)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			err = status.Error(codes.NotFound, fmt.Sprintf("Malformed snapshot ID: %s", snapshotID))
+		}
+		return nil, "", err
 	}
-	volumeID := req.GetVolumeId()
-	secret := req.GetControllerDeleteSecrets()
-
-	cluster := secret["clusterName"]
-	password := secret["clusterPassword"]
-	mount := filepath.Join(workingDir, cluster)
-	if err := prepareVstorage(cluster, password, mount); err != nil {
-		return nil, err
+	name := snapshotID[i+1:]
+	if err := validateName(name); err != nil {
+		return nil, "", err
 	}
+	return vol, name, nil
+}
 
-	ploopPath := path.Join(mount, secret["volumePath"], volumeID)
-	_, err := os.Stat(ploopPath)
-	if err != nil && os.IsNotExist(err) {
-		return &csi.DeleteVolumeResponse{}, nil
-	}
+func createSnapshot(id *volumeID, name, mount string) error {
+	ploopPath := id.ploopPath(mount)
+	snapshotsDir := id.snapshotsDir(mount)
+	snapshotPath := path.Join(snapshotsDir, name)
+
+	vol, err := ploop.PloopVolumeOpen(ploopPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if err := removePloop(volumeID, mount, secret); err != nil {
-		return nil, err
+	if err := os.MkdirAll(snapshotsDir, 0755); err != nil {
+		return fmt.Errorf("Error creating dir %s: %v", snapshotsDir, err)
 	}
 
-	return &csi.DeleteVolumeResponse{}, nil
+	glog.Infof("Snapshot: %s -> %s", ploopPath, snapshotPath)
+	if _, err := vol.Snapshot(snapshotPath); err != nil {
+		os.RemoveAll(snapshotPath)
+		return err
+	}
+
+	return nil
 }
 
-func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	// Check arguments
-	if len(req.GetVolumeId()) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+func removeSnapshot(snapshotPath string) error {
+	if _, err := os.Stat(filepath.Join(snapshotPath, "DiskDescriptor.xml")); os.IsNotExist(err) {
+		// a leftover of an interrupted CreateSnapshot
+		return os.RemoveAll(snapshotPath)
 	}
-	if req.GetVolumeCapabilities() == nil {
-		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+
+	snap, err := ploop.PloopVolumeSnapshotOpen(snapshotPath)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Delete snapshot: %s", snapshotPath)
+	if err := snap.Delete(); err != nil {
+		return err
 	}
+	os.RemoveAll(snapshotPath)
 
-	return &csi.ValidateVolumeCapabilitiesResponse{Supported: true, Message: ""}, nil
+	// remove the snapshot directory of the volume if it is empty
+	os.Remove(filepath.Dir(snapshotPath))
+	return nil
 }
 
-func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	// Check arguments
-	if len(req.GetVolumeId()) == 0 {
+// getSnapshot describes a snapshot which is stored in snapshotPath. A
+// snapshot is ready when ploop-volume has written its DiskDescriptor.xml.
+func getSnapshot(snapshotPath string, vol *volumeID, name string) (*csi.Snapshot, error) {
+	fi, err := os.Stat(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &csi.Snapshot{
+		SnapshotId:     makeSnapshotID(vol, name),
+		SourceVolumeId: vol.String(),
+		CreationTime:   timestamppb.New(fi.ModTime()),
+		ReadyToUse:     false,
+	}
+
+	size, err := getPloopCapacity(snapshotPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return snap, nil
+		}
+		return nil, err
+	}
+	snap.SizeBytes = int64(size)
+	snap.ReadyToUse = true
+
+	return snap, nil
+}
+
+// mountedClusters returns mount points of all clusters which are mounted in
+// workingDir and respond. List requests don't carry secrets, so they can
+// only look at clusters which have already been used by other requests.
+func mountedClusters() ([]string, error) {
+	entries, err := ioutil.ReadDir(workingDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	mounts := []string{}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == "mounts" {
+			continue
+		}
+		mount := filepath.Join(workingDir, e.Name())
+		if ok, _ := vstorage.IsVstorage(e.Name(), mount); !ok {
+			continue
+		}
+		if err := vstorage.CheckMount(mount, vstorage.MountTimeout); err != nil {
+			glog.Errorf("Cluster mount %s doesn't respond: %v", mount, err)
+			continue
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// controllerUser holds clusters which the controller has used, because List
+// requests and the garbage collector can only look at mounted clusters.
+const controllerUser = "controller"
+
+// capacityUser holds a cluster while GetCapacity looks at it
+const capacityUser = "capacity"
+
+// servedClusters returns mounted clusters like mountedClusters and keeps
+// them mounted for the controller, so they aren't unmounted while they
+// are being looked through and they are found by the next List request.
+func servedClusters(clusters *vstorage.MountManager) ([]string, error) {
+	mounts, err := mountedClusters()
+	if err != nil {
+		return nil, err
+	}
+	for _, mount := range mounts {
+		clusters.Hold(filepath.Base(mount), mount, controllerUser)
+	}
+	// a cluster could have been unmounted before it was held
+	return mountedClusters()
+}
+
+// listSnapshots collects snapshots of volumes in volumePath directories
+// dirs of a cluster mount. Other directories of the cluster can be used by
+// someone else, so they aren't looked through. Transient snapshots of
+// clones don't have valid names, so they are skipped too.
+func listSnapshots(mount string, dirs []string) ([]*csi.Snapshot, error) {
+	snaps := []*csi.Snapshot{}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(filepath.Join(mount, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, e := range entries {
+			name := strings.TrimSuffix(e.Name(), snapshotsSuffix)
+			if !e.IsDir() || name == e.Name() || validateName(name) != nil {
+				continue
+			}
+			p := filepath.Join(mount, dir, e.Name())
+			vol := volumeIDFromPath(mount, filepath.Join(mount, dir, name))
+			snapshots, err := ioutil.ReadDir(p)
+			if err != nil {
+				if os.IsNotExist(err) {
+					// the volume has been deleted
+					continue
+				}
+				return nil, err
+			}
+			for _, snap := range snapshots {
+				if validateName(snap.Name()) != nil {
+					continue
+				}
+				s, err := getSnapshot(filepath.Join(p, snap.Name()), vol, snap.Name())
+				if err != nil {
+					if os.IsNotExist(err) {
+						// the snapshot has been deleted
+						continue
+					}
+					return nil, err
+				}
+				snaps = append(snaps, s)
+			}
+		}
+	}
+	return snaps, nil
+}
+
+// findSnapshots returns snapshots called name of all volumes in volumePath
+// directories dirs of a cluster mount.
+func findSnapshots(mount string, dirs []string, name string) ([]string, error) {
+	found := []string{}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(filepath.Join(mount, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() || !strings.HasSuffix(e.Name(), snapshotsSuffix) {
+				continue
+			}
+			p := filepath.Join(mount, dir, e.Name(), name)
+			if _, err := os.Lstat(p); err == nil {
+				found = append(found, p)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	return found, nil
+}
+
+// listVolumes collects ploop volumes in volumePath directories dirs of a
+// cluster mount.
+func listVolumes(mount string, dirs []string) ([]*csi.Volume, error) {
+	vols := []*csi.Volume{}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(filepath.Join(mount, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() || validateName(e.Name()) != nil {
+				continue
+			}
+			p := filepath.Join(mount, dir, e.Name())
+			capacity, err := getPloopCapacity(p)
+			if err != nil {
+				if os.IsNotExist(err) {
+					// not a ploop volume or the volume has been
+					// deleted
+					continue
+				}
+				return nil, err
+			}
+			vols = append(vols, &csi.Volume{
+				VolumeId:      volumeIDFromPath(mount, p).String(),
+				CapacityBytes: int64(capacity),
+			})
+		}
+	}
+	return vols, nil
+}
+
+// paginate returns a range of sorted ids for a List request and a token to
+// get the next page. A token is an encoded ID of the first entry of a page,
+// so it stays valid when entries are added or removed between calls.
+func paginate(ids []string, maxEntries int32, startingToken string) (int, int, string, error) {
+	if maxEntries < 0 {
+		return 0, 0, "", status.Error(codes.InvalidArgument, "Negative max_entries in request")
+	}
+
+	start := 0
+	if startingToken != "" {
+		id, err := base64.StdEncoding.DecodeString(startingToken)
+		if err != nil || len(id) == 0 {
+			return 0, 0, "", status.Error(codes.Aborted, fmt.Sprintf("Invalid starting token: %s", startingToken))
+		}
+		start = sort.SearchStrings(ids, string(id))
+	}
+
+	end := len(ids)
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+
+	next := ""
+	if end < len(ids) {
+		next = base64.StdEncoding.EncodeToString([]byte(ids[end]))
+	}
+
+	return start, end, next, nil
+}
+
+type DiskParameters struct {
+	DiskSize uint64 `xml:"Disk_size"`
+}
+
+type ParallelsDiskImage struct {
+	DiskParameters DiskParameters `xml:"Disk_Parameters"`
+	Images         []string       `xml:"StorageData>Storage>Image>File"`
+}
+
+// volumeIDFromPath restores the ID of a volume which is found in ploopPath
+// on a cluster mounted in mount. Images of a volume are kept in deltasPath,
+// which is known only from its DiskDescriptor.xml. A volume which is being
+// deleted keeps its ID.
+func volumeIDFromPath(mount, ploopPath string) *volumeID {
+	volumePath, _ := filepath.Rel(mount, filepath.Dir(ploopPath))
+	if volumePath == "." {
+		volumePath = ""
+	}
+	vol := &volumeID{
+		cluster:    filepath.Base(mount),
+		volumePath: volumePath,
+		deltasPath: volumePath,
+		name:       strings.TrimSuffix(filepath.Base(ploopPath), deletedSuffix),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return vol
+	}
+	v := ParallelsDiskImage{}
+	if err := xml.Unmarshal(data, &v); err != nil {
+		return vol
+	}
+	for _, f := range v.Images {
+		imageDir := filepath.Dir(f)
+		if !filepath.IsAbs(f) || filepath.Base(imageDir) != vol.name+imageSuffix {
+			continue
+		}
+		if p, err := filepath.Rel(mount, filepath.Dir(imageDir)); err == nil && !strings.HasPrefix(p, "..") {
+			if p == "." {
+				p = ""
+			}
+			vol.deltasPath = p
+		}
+		break
+	}
+	return vol
+}
+
+func getPloopCapacity(ploopPath string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return 0, err
+	}
+
+	v := ParallelsDiskImage{}
+	err = xml.Unmarshal([]byte(data), &v)
+	if err != nil {
+		return 0, err
+	}
+	return v.DiskParameters.DiskSize * 512, nil
+}
+
+// roundPloopSize returns bytes rounded up to the cluster size of a ploop
+// volume, this is the size which the volume gets when it's resized.
+func roundPloopSize(ploopPath string, bytes uint64) (uint64, error) {
+	p, err := ploop.Open(filepath.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+
+	info, err := p.ImageInfo()
+	if err != nil {
+		return 0, err
+	}
+	// ploop reports the cluster block size in 512-byte sectors
+	clusterSize := uint64(info.BlockSize) * 512
+	if clusterSize == 0 {
+		return 0, fmt.Errorf("Unable to get the cluster size of %s", ploopPath)
+	}
+	return (bytes + clusterSize - 1) / clusterSize * clusterSize, nil
+}
+
+// resizePloop grows a ploop volume up to bytes rounded up to the ploop
+// cluster size. ploop resizes the image and the inner file system, online if
+// the volume is mounted on this host and offline otherwise. It returns the
+// new capacity of the volume.
+func resizePloop(ploopPath string, bytes uint64) (uint64, error) {
+	capacity, err := getPloopCapacity(ploopPath)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := roundPloopSize(ploopPath, bytes)
+	if err != nil {
+		return 0, err
+	}
+	if size <= capacity {
+		return capacity, nil
+	}
+
+	p, err := ploop.Open(filepath.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+
+	glog.Infof("Resize: %s %d -> %d", ploopPath, capacity, size)
+	// ploop driver takes kilobytes, so convert it
+	if err := p.Resize(size/1024, false); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// expandPloop is the controller part of a volume expansion. The inner file
+// system of a volume which is mounted on some node can be resized only
+// there, so the resize is left for the node in this case.
+func expandPloop(ploopPath string, bytes uint64) (uint64, bool, error) {
+	size, err := resizePloop(ploopPath, bytes)
+	if err != nil {
+		if ploop.IsError(err, ploop.E_PLOOPINUSE) ||
+			ploop.IsError(err, ploop.E_LOCK) ||
+			ploop.IsError(err, ploop.E_EBUSY) {
+			glog.Infof("%s is in use, it will be resized on the node: %v", ploopPath, err)
+			return bytes, true, nil
+		}
+		return 0, false, err
+	}
+
+	return size, false, nil
+}
+
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		glog.V(3).Infof("invalid create volume req: %v", csicommon.StripSecrets(req))
+		return nil, toStatus(err)
+	}
+
+	// Check arguments
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if req.GetVolumeCapabilities() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
+	}
+
+	// Volume Name
+	volName := diskName(req.GetName())
+
+	// Volume Size - Default is 1 GiB
+	volSizeBytes := uint64(1 * 1024 * 1024 * 1024)
+	if req.GetCapacityRange() != nil {
+		volSizeBytes = uint64(req.GetCapacityRange().GetRequiredBytes())
+	}
+
+	storageClassOptions := map[string]string{}
+
+	for k, v := range req.GetParameters() {
+		storageClassOptions[k] = v
+	}
+
+	fsType := storageClassOptions["kubernetes.io/fsType"]
+	for _, c := range req.GetVolumeCapabilities() {
+		if t := c.GetMount().GetFsType(); t != "" {
+			fsType = t
+		}
+	}
+	if !isSupportedFsType(fsType) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Unsupported file system type: %s", fsType))
+	}
+	if fsType != "" {
+		storageClassOptions["kubernetes.io/fsType"] = fsType
+	}
+
+	secret := req.GetSecrets()
+	vol := newVolumeID(volName, secret)
+	if err := vol.validate(); err != nil {
+		return nil, toStatus(err)
+	}
+	if err := checkIDLength(vol.String()); err != nil {
+		return nil, err
+	}
+
+	unlock, err := cs.volumeLocks.Lock(vol.String())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mount := vol.mountPath()
+	if err := cs.clusters.Acquire(vol.cluster, secret["clusterPassword"], mount, vol.String()); err != nil {
+		return nil, toStatus(err)
+	}
+	defer cs.clusters.Release(mount, vol.String())
+	cs.clusters.Hold(vol.cluster, mount, controllerUser)
+	if err := vol.resolve(mount); err != nil {
+		return nil, toStatus(err)
+	}
+	cs.dirs.add(vol)
+
+	snapshotPath := ""
+	if snapshot := req.GetVolumeContentSource().GetSnapshot(); snapshot != nil {
+		src, name, err := parseSnapshotID(snapshot.GetSnapshotId(), secret)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		if src.cluster != vol.cluster {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Snapshot %s is on another cluster", snapshot.GetSnapshotId()))
+		}
+		if err := src.resolve(mount); err != nil {
+			return nil, toStatus(err)
+		}
+		// the snapshot must not be deleted while it's being cloned
+		unlockSrc, err := cs.volumeLocks.Lock(makeSnapshotID(src, name))
+		if err != nil {
+			return nil, err
+		}
+		defer unlockSrc()
+		snapshotPath = path.Join(src.snapshotsDir(mount), name)
+
+		snapSize, err := getPloopCapacity(snapshotPath)
+		if err != nil && os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("Snapshot %s not found", snapshot.GetSnapshotId()))
+		}
+		if err != nil {
+			return nil, toStatus(err)
+		}
+
+		// A volume can't be smaller than its source snapshot
+		if snapSize > volSizeBytes {
+			limit := uint64(req.GetCapacityRange().GetLimitBytes())
+			if limit != 0 && limit < snapSize {
+				return nil, status.Error(codes.OutOfRange, fmt.Sprintf("Snapshot %s is bigger than the volume size limit", snapshot.GetSnapshotId()))
+			}
+			volSizeBytes = snapSize
+		}
+	}
+	var src *volumeID
+	if volume := req.GetVolumeContentSource().GetVolume(); volume != nil {
+		srcVolumeID := volume.GetVolumeId()
+		var err error
+		src, err = parseVolumeID(srcVolumeID, secret)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		if src.cluster != vol.cluster {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Volume %s is on another cluster", srcVolumeID))
+		}
+		if err := src.resolve(mount); err != nil {
+			return nil, toStatus(err)
+		}
+		unlockSrc, err := cs.volumeLocks.Lock(src.String())
+		if err != nil {
+			return nil, err
+		}
+		defer unlockSrc()
+		srcSize, err := getPloopCapacity(src.ploopPath(mount))
+		if err != nil && os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume %s not found", srcVolumeID))
+		}
+		if err != nil {
+			return nil, toStatus(err)
+		}
+
+		// A clone can't be smaller than its source volume
+		if srcSize > volSizeBytes {
+			limit := uint64(req.GetCapacityRange().GetLimitBytes())
+			if limit != 0 && limit < srcSize {
+				return nil, status.Error(codes.OutOfRange, fmt.Sprintf("Volume %s is bigger than the volume size limit", srcVolumeID))
+			}
+			volSizeBytes = srcSize
+		}
+	}
+	storageClassOptions["size"] = fmt.Sprintf("%d", volSizeBytes)
+
+	ploopPath := vol.ploopPath(mount)
+
+	// a leftover of an interrupted creation is rolled back and the volume
+	// is created again
+	_, err = os.Stat(filepath.Join(ploopPath, "DiskDescriptor.xml"))
+	if err == nil {
+		capacity, err := getPloopCapacity(ploopPath)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		if capacity >= volSizeBytes {
+			return &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					VolumeId:      vol.String(),
+					VolumeContext: vol.volumeContext(storageClassOptions),
+					CapacityBytes: int64(volSizeBytes),
+				},
+			}, nil
+		} else {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different size already exist", req.GetName()))
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, toStatus(err)
+	}
+
+	if snapshotPath != "" {
+		err = clonePloop(vol, mount, storageClassOptions, snapshotPath, volSizeBytes)
+	} else if src != nil {
+		err = clonePloopVolume(src, vol, mount, storageClassOptions, volSizeBytes)
+	} else {
+		err = createPloop(vol, mount, storageClassOptions, volSizeBytes)
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      vol.String(),
+			VolumeContext: vol.volumeContext(storageClassOptions),
+			CapacityBytes: int64(volSizeBytes),
+			ContentSource: req.GetVolumeContentSource(),
+		},
+	}, nil
+}
+
+func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		glog.V(3).Infof("invalid delete volume req: %v", csicommon.StripSecrets(req))
+		return nil, toStatus(err)
+	}
+	secret := req.GetSecrets()
+	vol, err := parseVolumeID(req.GetVolumeId(), secret)
+	if err != nil && status.Code(err) == codes.NotFound {
+		// such volume can't exist
+		glog.V(3).Infof("%v", err)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	unlock, err := cs.volumeLocks.Lock(vol.String())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mount := vol.mountPath()
+	if err := cs.clusters.Acquire(vol.cluster, secret["clusterPassword"], mount, vol.String()); err != nil {
+		return nil, toStatus(err)
+	}
+	defer cs.clusters.Release(mount, vol.String())
+	cs.clusters.Hold(vol.cluster, mount, controllerUser)
+	if err := vol.resolve(mount); err != nil {
+		return nil, toStatus(err)
+	}
+	cs.dirs.add(vol)
+
+	// the driver never makes a volume directory without DiskDescriptor.xml,
+	// so it isn't ours and it's left as is
+	foreign, err := isForeign(vol.ploopPath(mount))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if foreign {
+		glog.Infof("%s isn't a ploop volume, it isn't deleted", vol.ploopPath(mount))
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	_, err = os.Stat(filepath.Join(vol.ploopPath(mount), "DiskDescriptor.xml"))
+	if err == nil {
+		if err := checkPloopUnused(vol, mount); err != nil {
+			return nil, toStatus(err)
+		}
+		if err := removePloop(vol, mount, volumePathDirs(mount, cs.dirs.volumePaths(mount))); err != nil {
+			return nil, toStatus(err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, toStatus(err)
+	}
+
+	if err := removePloopRemnants(vol, mount, volumePathDirs(mount, cs.dirs.volumePaths(mount))); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetVolumeCapabilities() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+	}
+
+	// IDs are locked in their canonical form like in other requests
+	vol, err := parseVolumeID(req.GetVolumeId(), volumeLocation(req.GetSecrets(), req.GetVolumeContext()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	unlock, err := cs.volumeLocks.Lock(vol.String())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for _, c := range req.GetVolumeCapabilities() {
+		if msg := cs.validateVolumeCapability(c); msg != "" {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: msg}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// validateVolumeCapability returns a reason why a volume capability isn't
+// supported or an empty string. A ploop volume can be used either as a
+// mounted file system or as a raw block device.
+func (cs *controllerServer) validateVolumeCapability(c *csi.VolumeCapability) string {
+	if c.GetBlock() == nil && c.GetMount() == nil {
+		return "Access type isn't specified"
+	}
+	if t := c.GetMount().GetFsType(); !isSupportedFsType(t) {
+		return fmt.Sprintf("File system type %s isn't supported", t)
+	}
+
+	mode := c.GetAccessMode().GetMode()
+	for _, m := range cs.Driver.GetVolumeCapabilityAccessModes() {
+		if m.GetMode() == mode {
+			return ""
+		}
+	}
+	return fmt.Sprintf("Access mode %s isn't supported", mode.String())
+}
+
+func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
 	if len(req.GetNodeId()) == 0 {
@@ -351,10 +1336,21 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 		return nil, status.Error(codes.InvalidArgument, "Volume Capability missing in request")
 	}
 
+	vol, err := parseVolumeID(req.GetVolumeId(), volumeLocation(req.GetSecrets(), req.GetVolumeContext()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	unlock, err := cs.volumeLocks.Lock(vol.String())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	// Publish Volume Info
 	pvInfo := map[string]string{}
 	return &csi.ControllerPublishVolumeResponse{
-		PublishInfo: pvInfo,
+		PublishContext: pvInfo,
 	}, nil
 }
 
@@ -364,5 +1360,400 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
 
+	vol, err := parseVolumeID(req.GetVolumeId(), req.GetSecrets())
+	if err != nil && status.Code(err) == codes.NotFound {
+		// such volume can't exist
+		glog.V(3).Infof("%v", err)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	unlock, err := cs.volumeLocks.Lock(vol.String())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
+
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		glog.V(3).Infof("invalid list volumes req: %v", csicommon.StripSecrets(req))
+		return nil, toStatus(err)
+	}
+
+	mounts, err := servedClusters(cs.clusters)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	vols := map[string]*csi.Volume{}
+	for _, mount := range mounts {
+		v, err := listVolumes(mount, cs.dirs.volumePaths(mount))
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		for _, vol := range v {
+			if _, ok := vols[vol.GetVolumeId()]; ok {
+				glog.Errorf("Volume %s is found more than once", vol.GetVolumeId())
+				continue
+			}
+			vols[vol.GetVolumeId()] = vol
+		}
+	}
+
+	ids := []string{}
+	for id := range vols {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	start, end, next, err := paginate(ids, req.GetMaxEntries(), req.GetStartingToken())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	entries := []*csi.ListVolumesResponse_Entry{}
+	for _, id := range ids[start:end] {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{Volume: vols[id]})
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: next,
+	}, nil
+}
+
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		glog.V(3).Infof("invalid get capacity req: %v", csicommon.StripSecrets(req))
+		return nil, toStatus(err)
+	}
+
+	params := req.GetParameters()
+	replicas := 0
+	if v, ok := params["vzsReplicas"]; ok {
+		r, err := vstorage.ParseReplicas(v)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		replicas = r
+	}
+	tier := -1
+	if v, ok := params["vzsTier"]; ok {
+		t, err := strconv.Atoi(v)
+		if err != nil || t < 0 {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid tier: %s", v))
+		}
+		tier = t
+	}
+
+	// GetCapacity doesn't carry secrets, so the cluster comes from
+	// parameters of a StorageClass. It can be mounted only if it's already
+	// mounted on this host, because there is no password.
+	cluster := params[clusterNameKey]
+	if cluster == "" {
+		return nil, status.Error(codes.InvalidArgument, "clusterName isn't specified in parameters")
+	}
+	if err := validateClusterName(cluster); err != nil {
+		return nil, err
+	}
+
+	mount := filepath.Join(workingDir, cluster)
+	if err := cs.clusters.Acquire(cluster, "", mount, capacityUser); err != nil {
+		return nil, toStatus(err)
+	}
+	defer cs.clusters.Release(mount, capacityUser)
+	cs.clusters.Hold(cluster, mount, controllerUser)
+
+	v := vstorage.Vstorage{
+		Name: cluster,
+	}
+	st, err := v.Stat()
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: int64(st.Available(tier, replicas)),
+	}, nil
+}
+
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		glog.V(3).Infof("invalid create snapshot req: %v", csicommon.StripSecrets(req))
+		return nil, toStatus(err)
+	}
+
+	// Check arguments
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Source Volume ID missing in request")
+	}
+
+	name := diskName(req.GetName())
+	volumeID := req.GetSourceVolumeId()
+	secret := req.GetSecrets()
+	vol, err := parseVolumeID(volumeID, secret)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if err := checkIDLength(makeSnapshotID(vol, name)); err != nil {
+		return nil, err
+	}
+
+	// the name is locked in the cluster too, so it can't be taken by two
+	// volumes at once
+	unlock, err := cs.volumeLocks.Lock(vol.String(), makeSnapshotID(vol, name), vol.cluster+snapshotIDSep+name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mount := vol.mountPath()
+	if err := cs.clusters.Acquire(vol.cluster, secret["clusterPassword"], mount, vol.String()); err != nil {
+		return nil, toStatus(err)
+	}
+	defer cs.clusters.Release(mount, vol.String())
+	cs.clusters.Hold(vol.cluster, mount, controllerUser)
+	if err := vol.resolve(mount); err != nil {
+		return nil, toStatus(err)
+	}
+	cs.dirs.add(vol)
+
+	ploopPath := vol.ploopPath(mount)
+	snapshotPath := path.Join(vol.snapshotsDir(mount), name)
+
+	// Snapshot names are unique across all volumes, volume paths can be
+	// symlinks to each other
+	matches, err := findSnapshots(mount, cs.dirs.volumePaths(mount), name)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	own, _ := os.Lstat(snapshotPath)
+	for _, m := range matches {
+		if fi, err := os.Lstat(m); err == nil && own != nil && os.SameFile(fi, own) {
+			continue
+		}
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Snapshot with the same name: %s but for another volume already exist", name))
+	}
+
+	_, err = os.Stat(ploopPath)
+	if err != nil && os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Source volume %s not found", volumeID))
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	snap, err := getSnapshot(snapshotPath, vol, name)
+	if err == nil {
+		if snap.GetReadyToUse() {
+			return &csi.CreateSnapshotResponse{Snapshot: snap}, nil
+		}
+		if err := removeSnapshot(snapshotPath); err != nil {
+			return nil, toStatus(err)
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, toStatus(err)
+	}
+
+	if err := createSnapshot(vol, name, mount); err != nil {
+		return nil, toStatus(err)
+	}
+
+	snap, err = getSnapshot(snapshotPath, vol, name)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &csi.CreateSnapshotResponse{Snapshot: snap}, nil
+}
+
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	// Check arguments
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		glog.V(3).Infof("invalid delete snapshot req: %v", csicommon.StripSecrets(req))
+		return nil, toStatus(err)
+	}
+
+	secret := req.GetSecrets()
+	vol, name, err := parseSnapshotID(req.GetSnapshotId(), secret)
+	if err != nil && status.Code(err) == codes.NotFound {
+		// such snapshot can't exist
+		glog.V(3).Infof("%v", err)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	unlock, err := cs.volumeLocks.Lock(makeSnapshotID(vol, name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mount := vol.mountPath()
+	if err := cs.clusters.Acquire(vol.cluster, secret["clusterPassword"], mount, vol.String()); err != nil {
+		return nil, toStatus(err)
+	}
+	defer cs.clusters.Release(mount, vol.String())
+	cs.clusters.Hold(vol.cluster, mount, controllerUser)
+	if err := vol.resolve(mount); err != nil {
+		return nil, toStatus(err)
+	}
+	cs.dirs.add(vol)
+
+	snapshotPath := path.Join(vol.snapshotsDir(mount), name)
+	_, err = os.Stat(snapshotPath)
+	if err != nil && os.IsNotExist(err) {
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	if err := removeSnapshot(snapshotPath); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		glog.V(3).Infof("invalid list snapshots req: %v", csicommon.StripSecrets(req))
+		return nil, toStatus(err)
+	}
+
+	mounts, err := servedClusters(cs.clusters)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	snaps := map[string]*csi.Snapshot{}
+	for _, mount := range mounts {
+		s, err := listSnapshots(mount, cs.dirs.volumePaths(mount))
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		for _, snap := range s {
+			if req.GetSnapshotId() != "" && snap.GetSnapshotId() != req.GetSnapshotId() {
+				continue
+			}
+			if req.GetSourceVolumeId() != "" && snap.GetSourceVolumeId() != req.GetSourceVolumeId() {
+				continue
+			}
+			snaps[snap.GetSnapshotId()] = snap
+		}
+	}
+
+	ids := []string{}
+	for id := range snaps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	start, end, next, err := paginate(ids, req.GetMaxEntries(), req.GetStartingToken())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, id := range ids[start:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snaps[id]})
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: next,
+	}, nil
+}
+
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		glog.V(3).Infof("invalid expand volume req: %v", csicommon.StripSecrets(req))
+		return nil, toStatus(err)
+	}
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetCapacityRange() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range missing in request")
+	}
+
+	bytes := uint64(req.GetCapacityRange().GetRequiredBytes())
+	limit := uint64(req.GetCapacityRange().GetLimitBytes())
+	if limit != 0 && limit < bytes {
+		return nil, status.Error(codes.InvalidArgument, "Required bytes exceed limit bytes")
+	}
+
+	secret := req.GetSecrets()
+	vol, err := parseVolumeID(req.GetVolumeId(), secret)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	unlock, err := cs.volumeLocks.Lock(vol.String())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mount := vol.mountPath()
+	if err := cs.clusters.Acquire(vol.cluster, secret["clusterPassword"], mount, vol.String()); err != nil {
+		return nil, toStatus(err)
+	}
+	defer cs.clusters.Release(mount, vol.String())
+	cs.clusters.Hold(vol.cluster, mount, controllerUser)
+	if err := vol.resolve(mount); err != nil {
+		return nil, toStatus(err)
+	}
+	cs.dirs.add(vol)
+
+	ploopPath := vol.ploopPath(mount)
+	capacity, err := getPloopCapacity(ploopPath)
+	if err != nil && os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume %s not found", req.GetVolumeId()))
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	if capacity >= bytes {
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: int64(capacity)}, nil
+	}
+
+	// the size is rounded up by ploop, so it's checked before the volume
+	// is resized
+	size, err := roundPloopSize(ploopPath, bytes)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if limit != 0 && size > limit {
+		return nil, status.Error(codes.OutOfRange, fmt.Sprintf("Volume %s can't be resized within the limit", req.GetVolumeId()))
+	}
+
+	size, nodeExpansion, err := expandPloop(ploopPath, bytes)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         int64(size),
+		NodeExpansionRequired: nodeExpansion,
+	}, nil
+}
@@ -0,0 +1,365 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func testVolume(t *testing.T) (*volumeID, string) {
+	mount := t.TempDir()
+	vol := newVolumeID("pvc-1", map[string]string{
+		"clusterName": "stor1",
+		"volumePath":  "volumes",
+		"deltasPath":  "deltas",
+	})
+	for _, d := range []string{"volumes", "deltas"} {
+		assert.NoError(t, os.Mkdir(filepath.Join(mount, d), 0755))
+	}
+	return vol, mount
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestRollbackPloopLeftovers(t *testing.T) {
+	vol, mount := testVolume(t)
+	ploopPath := vol.ploopPath(mount)
+	imageDir := vol.imageDir(mount)
+
+	// interrupted before the volume was renamed
+	assert.NoError(t, os.Mkdir(ploopPath+creatingSuffix, 0755))
+	assert.NoError(t, os.Mkdir(imageDir, 0755))
+	assert.NoError(t, rollbackPloop(vol, mount))
+	assert.False(t, exists(ploopPath+creatingSuffix))
+	assert.False(t, exists(imageDir))
+}
+
+func TestRollbackPloopKeepsForeignDirs(t *testing.T) {
+	vol, mount := testVolume(t)
+	ploopPath := vol.ploopPath(mount)
+	imageDir := vol.imageDir(mount)
+
+	// a directory with the name of the volume which isn't a ploop volume
+	data := filepath.Join(ploopPath, "data")
+	assert.NoError(t, os.MkdirAll(data, 0755))
+	assert.NoError(t, os.Mkdir(imageDir, 0755))
+	assert.NoError(t, os.Mkdir(ploopPath+creatingSuffix, 0755))
+
+	err := rollbackPloop(vol, mount)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	for _, p := range []string{data, imageDir, ploopPath + creatingSuffix} {
+		assert.True(t, exists(p), p)
+	}
+}
+
+func TestRollbackPloopKeepsVolumes(t *testing.T) {
+	vol, mount := testVolume(t)
+	ploopPath := vol.ploopPath(mount)
+	imageDir := vol.imageDir(mount)
+
+	// images without a leftover directory may belong to someone else
+	assert.NoError(t, os.Mkdir(imageDir, 0755))
+	assert.NoError(t, rollbackPloop(vol, mount))
+	assert.True(t, exists(imageDir))
+
+	// a complete volume and a stale temporary directory
+	assert.NoError(t, os.Mkdir(ploopPath, 0755))
+	dd := filepath.Join(ploopPath, "DiskDescriptor.xml")
+	assert.NoError(t, ioutil.WriteFile(dd, []byte("<Parallels_disk_image/>"), 0644))
+	assert.NoError(t, os.Mkdir(ploopPath+creatingSuffix, 0755))
+	assert.NoError(t, rollbackPloop(vol, mount))
+	assert.True(t, exists(dd))
+	assert.True(t, exists(imageDir))
+	assert.False(t, exists(ploopPath+creatingSuffix))
+}
+
+func TestCheckPloopUnused(t *testing.T) {
+	vol, mount := testVolume(t)
+	ploopPath := vol.ploopPath(mount)
+	writeDiskDescriptor(t, ploopPath)
+	assert.NoError(t, checkPloopUnused(vol, mount))
+
+	// staged on two nodes
+	for _, node := range []string{"node-1", "node-2"} {
+		marked, err := markStaged(ploopPath, node)
+		assert.NoError(t, err)
+		assert.True(t, marked)
+	}
+	marked, err := markStaged(ploopPath, "node-1")
+	assert.NoError(t, err)
+	assert.False(t, marked)
+
+	err = checkPloopUnused(vol, mount)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "node-2")
+
+	for _, node := range []string{"node-1", "node-2"} {
+		assert.NoError(t, unmarkStaged(ploopPath, node))
+	}
+	assert.False(t, exists(ploopPath+stagedSuffix))
+	assert.NoError(t, checkPloopUnused(vol, mount))
+
+	// snapshots of interrupted clones don't count
+	snapshotsDir := vol.snapshotsDir(mount)
+	assert.NoError(t, os.MkdirAll(filepath.Join(snapshotsDir, cloneSnapshotPrefix+"pvc-2"), 0755))
+	assert.NoError(t, checkPloopUnused(vol, mount))
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(snapshotsDir, "snap-1"), 0755))
+	err = checkPloopUnused(vol, mount)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestStagedNodesStaleMarks(t *testing.T) {
+	vol, mount := testVolume(t)
+	ploopPath := vol.ploopPath(mount)
+	writeDiskDescriptor(t, ploopPath)
+
+	for _, node := range []string{"node-1", "node-2"} {
+		_, err := markStaged(ploopPath, node)
+		assert.NoError(t, err)
+	}
+	// node-2 is gone and doesn't refresh its mark
+	old := time.Now().Add(-2 * staleMarkTimeout)
+	for _, node := range []string{"node-1", "node-2"} {
+		assert.NoError(t, os.Chtimes(filepath.Join(ploopPath+stagedSuffix, node), old, old))
+	}
+	assert.NoError(t, refreshStaged(ploopPath, "node-1"))
+
+	nodes, err := stagedNodes(ploopPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node-1"}, nodes)
+	assert.False(t, exists(filepath.Join(ploopPath+stagedSuffix, "node-2")))
+
+	// a removed mark isn't created again
+	assert.NoError(t, unmarkStaged(ploopPath, "node-1"))
+	assert.NoError(t, refreshStaged(ploopPath, "node-1"))
+	assert.False(t, exists(ploopPath+stagedSuffix))
+	assert.NoError(t, checkPloopUnused(vol, mount))
+}
+
+func TestRemovePloopRemnants(t *testing.T) {
+	vol, mount := testVolume(t)
+	ploopPath := vol.ploopPath(mount)
+	imageDir := vol.imageDir(mount)
+
+	// ploop-volume delete has removed the metadata, but not the images
+	assert.NoError(t, os.MkdirAll(ploopPath+deletedSuffix, 0755))
+	assert.NoError(t, os.MkdirAll(imageDir, 0755))
+	_, err := markStaged(ploopPath, "node-1")
+	assert.NoError(t, err)
+
+	assert.NoError(t, removePloopRemnants(vol, mount, nil))
+	for _, p := range []string{ploopPath + deletedSuffix, ploopPath + stagedSuffix} {
+		assert.False(t, exists(p), p)
+	}
+	// images without DiskDescriptor.xml are left for the garbage collector
+	assert.True(t, exists(imageDir))
+
+	// nothing is left
+	assert.NoError(t, removePloopRemnants(vol, mount, nil))
+}
+
+func TestRemovePloopRemnantsKeepsSnapshotImages(t *testing.T) {
+	vol, mount := testVolume(t)
+	imageDir := vol.imageDir(mount)
+
+	assert.NoError(t, os.MkdirAll(imageDir, 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(vol.snapshotsDir(mount), "snap-1"), 0755))
+	assert.NoError(t, removePloopRemnants(vol, mount, nil))
+	assert.True(t, exists(imageDir))
+}
+
+func TestIsForeign(t *testing.T) {
+	vol, mount := testVolume(t)
+	ploopPath := vol.ploopPath(mount)
+
+	foreign, err := isForeign(ploopPath)
+	assert.NoError(t, err)
+	assert.False(t, foreign)
+
+	// a file of someone else with the name of a volume
+	assert.NoError(t, ioutil.WriteFile(ploopPath, []byte("important"), 0644))
+	foreign, err = isForeign(ploopPath)
+	assert.NoError(t, err)
+	assert.True(t, foreign)
+	assert.NoError(t, os.Remove(ploopPath))
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(ploopPath, "data"), 0755))
+	foreign, err = isForeign(ploopPath)
+	assert.NoError(t, err)
+	assert.True(t, foreign)
+	assert.NoError(t, os.RemoveAll(ploopPath))
+
+	writeDiskDescriptor(t, ploopPath)
+	foreign, err = isForeign(ploopPath)
+	assert.NoError(t, err)
+	assert.False(t, foreign)
+}
+
+func TestGetCapacityArguments(t *testing.T) {
+	cs := NewControllerServer(NewDriver("node1", "unix:///tmp/csi.sock"))
+
+	for _, params := range []map[string]string{
+		nil,
+		{"vzsTier": "0"},
+		{"clusterName": "mounts"},
+		{"clusterName": "../stor1"},
+		{"clusterName": "stor1", "vzsTier": "-1"},
+		{"clusterName": "stor1", "vzsReplicas": "0"},
+	} {
+		_, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: params})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "%v", params)
+	}
+}
+
+func TestListVolumesAndSnapshots(t *testing.T) {
+	mount := t.TempDir()
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/pvc-1"), filepath.Join(mount, "deltas/pvc-1.image/root.hds"))
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/pvc-1.snapshots/snap-1"))
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/pvc-1.snapshots", cloneSnapshotPrefix+"pvc-3"))
+	// a deletion and a directory of someone else
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/pvc-2.deleted"))
+	assert.NoError(t, os.MkdirAll(filepath.Join(mount, "volumes/data"), 0755))
+	// a name which the driver never creates
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/_pvc-4"))
+	// volumes in directories which aren't known
+	writeDiskDescriptor(t, filepath.Join(mount, "other/pvc-5"))
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/nested/pvc-6"))
+
+	vols, err := listVolumes(mount, []string{"volumes", "missing"})
+	assert.NoError(t, err)
+	if assert.Len(t, vols, 1) {
+		assert.Equal(t, "1:"+filepath.Base(mount)+":volumes:deltas:pvc-1", vols[0].GetVolumeId())
+	}
+
+	snaps, err := listSnapshots(mount, []string{"volumes", "missing"})
+	assert.NoError(t, err)
+	if assert.Len(t, snaps, 1) {
+		assert.Equal(t, vols[0].GetVolumeId(), snaps[0].GetSourceVolumeId())
+		assert.True(t, snaps[0].GetReadyToUse())
+	}
+}
+
+func TestFindSnapshots(t *testing.T) {
+	mount := t.TempDir()
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/pvc-1.snapshots/snap-1"))
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/pvc-2.snapshots/snap-2"))
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes2/pvc-3.snapshots/snap-1"))
+	// a directory which isn't known
+	writeDiskDescriptor(t, filepath.Join(mount, "other/pvc-4.snapshots/snap-1"))
+
+	found, err := findSnapshots(mount, []string{"volumes", "volumes2", "missing"}, "snap-1")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(mount, "volumes/pvc-1.snapshots/snap-1"),
+		filepath.Join(mount, "volumes2/pvc-3.snapshots/snap-1"),
+	}, found)
+
+	found, err = findSnapshots(mount, []string{"volumes"}, "snap-3")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func TestFsTypes(t *testing.T) {
+	cs := NewControllerServer(NewDriver("node1", "unix:///tmp/csi.sock"))
+	mode := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}
+	capability := func(fsType string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+			AccessMode: mode,
+		}
+	}
+
+	for _, fsType := range []string{"", "ext4"} {
+		assert.Empty(t, cs.validateVolumeCapability(capability(fsType)), fsType)
+		assert.NoError(t, checkCloneFsType(map[string]string{"kubernetes.io/fsType": fsType}))
+	}
+	for _, fsType := range []string{"xfs", "ext3", "btrfs"} {
+		assert.NotEmpty(t, cs.validateVolumeCapability(capability(fsType)), fsType)
+
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "pvc-1",
+			VolumeCapabilities: []*csi.VolumeCapability{capability(fsType)},
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), fsType)
+
+		// a clone can't get another file system than its source
+		vol, mount := testVolume(t)
+		src := newVolumeID("pvc-2", map[string]string{"clusterName": "stor1", "volumePath": "volumes"})
+		err = clonePloopVolume(src, vol, mount, map[string]string{"kubernetes.io/fsType": fsType}, 1<<30)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), fsType)
+		assert.False(t, exists(src.snapshotsDir(mount)))
+		assert.False(t, exists(vol.ploopPath(mount)+creatingSuffix))
+	}
+}
+
+func TestCheckCloneImages(t *testing.T) {
+	vol, mount := testVolume(t)
+	tmpPath := vol.ploopPath(mount) + creatingSuffix
+	imageDir := vol.imageDir(mount)
+
+	writeDiskDescriptor(t, tmpPath, filepath.Join(imageDir, "root.hds"), "root.hds.clone")
+	assert.NoError(t, checkCloneImages(tmpPath, imageDir))
+
+	// the clone uses images of its source
+	src := newVolumeID("pvc-2", map[string]string{"clusterName": "stor1", "volumePath": "volumes", "deltasPath": "deltas"})
+	writeDiskDescriptor(t, tmpPath, filepath.Join(src.imageDir(mount), "root.hds"), "root.hds.clone")
+	err := checkCloneImages(tmpPath, imageDir)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestRemoveDeletedPloopKeepsUsedImages(t *testing.T) {
+	vol, mount := testVolume(t)
+	imageDir := vol.imageDir(mount)
+	ploopPathTmp := vol.ploopPath(mount) + deletedSuffix
+	dirs := []string{filepath.Join(mount, "volumes")}
+
+	writeDiskDescriptor(t, ploopPathTmp, filepath.Join(imageDir, "root.hds"))
+	assert.NoError(t, os.MkdirAll(imageDir, 0755))
+
+	// a clone of the volume uses its base image
+	clone := filepath.Join(mount, "volumes/pvc-2")
+	writeDiskDescriptor(t, clone, filepath.Join(imageDir, "root.hds"), filepath.Join(mount, "deltas/pvc-2.image/root.hds"))
+
+	err := removeDeletedPloop(ploopPathTmp, imageDir, dirs)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), clone)
+	assert.True(t, exists(imageDir))
+	assert.True(t, exists(ploopPathTmp))
+
+	// and so does a snapshot of the clone
+	assert.NoError(t, os.RemoveAll(clone))
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/pvc-3.snapshots/snap-1"), filepath.Join(imageDir, "root.hds"))
+	err = removeDeletedPloop(ploopPathTmp, imageDir, dirs)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	assert.NoError(t, os.RemoveAll(filepath.Join(mount, "volumes/pvc-3.snapshots")))
+	assert.NoError(t, checkImagesUnused(dirs, imageDir, ploopPathTmp))
+}
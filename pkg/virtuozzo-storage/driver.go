@@ -17,10 +17,16 @@ limitations under the License.
 package vstorage
 
 import (
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"expvar"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 
 	"github.com/avagin/csi-vstorage/pkg/csi-common"
+	"github.com/avagin/csi-vstorage/pkg/virtuozzo-storage/vstorage"
 )
 
 type driver struct {
@@ -32,14 +38,22 @@ type driver struct {
 
 	cap   []*csi.VolumeCapability_AccessMode
 	cscap []*csi.ControllerServiceCapability
+
+	gcInterval time.Duration
+	gcDryRun   bool
+
+	clusters *vstorage.MountManager
 }
 
 const (
 	driverName = "csi-vstorageplugin"
+
+	// clusters which aren't used by any volume are unmounted
+	clusterIdleTimeout = 10 * time.Minute
 )
 
 var (
-	version = "0.2.0"
+	version = "1.0.0"
 )
 
 func NewDriver(nodeID, endpoint string) *driver {
@@ -48,12 +62,34 @@ func NewDriver(nodeID, endpoint string) *driver {
 	d := &driver{}
 
 	d.endpoint = endpoint
+	d.clusters = vstorage.NewMountManager(clusterIdleTimeout)
 
 	csiDriver := csicommon.NewCSIDriver(driverName, version, nodeID)
 	csiDriver.AddControllerServiceCapabilities(
 		[]csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		})
+	csiDriver.AddNodeServiceCapabilities(
+		[]csi.NodeServiceCapability_RPC_Type{
+			csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+			csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+			csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+			csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+		})
+	csiDriver.AddPluginServiceCapabilities(
+		[]csi.PluginCapability_Service_Type{
+			csi.PluginCapability_Service_CONTROLLER_SERVICE,
+		})
+	csiDriver.AddPluginVolumeExpansionCapabilities(
+		[]csi.PluginCapability_VolumeExpansion_Type{
+			csi.PluginCapability_VolumeExpansion_ONLINE,
 		})
 	csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 
@@ -65,15 +101,75 @@ func NewDriver(nodeID, endpoint string) *driver {
 func NewControllerServer(d *driver) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d.csiDriver),
+		volumeLocks:             csicommon.NewVolumeLocks(),
+		clusters:                d.clusters,
+		dirs:                    newVolumeDirs(),
+	}
+}
+
+func NewIdentityServer(d *driver) *identityServer {
+	return &identityServer{
+		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d.csiDriver),
+		clusters:              d.clusters,
 	}
 }
 
 func NewNodeServer(d *driver) *nodeServer {
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.csiDriver),
+		volumeLocks:       csicommon.NewVolumeLocks(),
+		clusters:          d.clusters,
+		volumes:           map[string]*stagedVolume{},
 	}
 }
 
+// EnableGC starts the garbage collector of interrupted deletions and orphan
+// images on Run. It must be enabled only for one controller.
+func (d *driver) EnableGC(interval time.Duration, dryRun bool) {
+	d.gcInterval = interval
+	d.gcDryRun = dryRun
+}
+
+// ServeMetrics exposes metrics of the driver on /debug/vars.
+func (d *driver) ServeMetrics(address string) {
+	go func() {
+		if err := http.ListenAndServe(address, nil); err != nil {
+			glog.Errorf("Unable to serve metrics on %s: %v", address, err)
+		}
+	}()
+}
+
 func (d *driver) Run() {
-	csicommon.RunControllerandNodePublishServer(d.endpoint, d.csiDriver, NewControllerServer(d), NewNodeServer(d))
+	// clusters which have been mounted before are unmounted when they are
+	// idle
+	mounts, err := mountedClusters()
+	if err != nil {
+		glog.Errorf("Unable to list mounted clusters: %v", err)
+	}
+	for _, mount := range mounts {
+		d.clusters.Adopt(filepath.Base(mount), mount)
+	}
+	go d.clusters.Run(time.Minute)
+	expvar.Publish("vstorage_cluster_mounts", expvar.Func(func() interface{} {
+		return d.clusters.State()
+	}))
+
+	cs := NewControllerServer(d)
+	if d.gcInterval > 0 {
+		gc := &garbageCollector{
+			interval: d.gcInterval,
+			dryRun:   d.gcDryRun,
+			locks:    cs.volumeLocks,
+			dirs:     cs.dirs,
+			clusters: cs.clusters,
+		}
+		go gc.run()
+	}
+	ns := NewNodeServer(d)
+	ns.recoverState()
+	go ns.refreshMarks(stagedMarkRefresh)
+
+	s := csicommon.NewNonBlockingGRPCServer()
+	s.Start(d.endpoint, NewIdentityServer(d), cs, ns)
+	s.Wait()
 }
@@ -0,0 +1,115 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/kolyshkin/goploop-cli"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/avagin/csi-vstorage/pkg/virtuozzo-storage/vstorage"
+)
+
+// ploopCodes maps ploop exit codes to gRPC codes. All other ploop errors
+// are reported as Internal.
+var ploopCodes = map[int]codes.Code{
+	// a volume is mounted or used by someone else
+	ploop.E_PLOOPINUSE: codes.FailedPrecondition,
+	ploop.E_EBUSY:      codes.FailedPrecondition,
+	// a concurrent operation holds the volume, it can be retried
+	ploop.E_LOCK:  codes.Aborted,
+	ploop.E_FLOCK: codes.Aborted,
+	ploop.E_ABORT: codes.Aborted,
+	// there is no space in a cluster for a new image
+	ploop.E_FALLOCATE: codes.ResourceExhausted,
+	ploop.E_NOSNAP:    codes.NotFound,
+	ploop.E_PARAM:     codes.InvalidArgument,
+}
+
+// vstorageCodes maps failed vstorage operations to gRPC codes.
+var vstorageCodes = map[string]codes.Code{
+	vstorage.OpAuth:  codes.Unauthenticated,
+	vstorage.OpMount: codes.Unavailable,
+}
+
+// errnoCodes maps errors of file operations on a cluster to gRPC codes.
+var errnoCodes = map[syscall.Errno]codes.Code{
+	syscall.ENOENT:    codes.NotFound,
+	syscall.EEXIST:    codes.AlreadyExists,
+	syscall.EACCES:    codes.PermissionDenied,
+	syscall.EPERM:     codes.PermissionDenied,
+	syscall.ENOSPC:    codes.ResourceExhausted,
+	syscall.EDQUOT:    codes.ResourceExhausted,
+	syscall.EBUSY:     codes.FailedPrecondition,
+	syscall.ENOTEMPTY: codes.FailedPrecondition,
+	syscall.ENOTCONN:  codes.Unavailable,
+}
+
+// toStatus translates an error from ploop, vstorage or a file operation to
+// a gRPC status error with a proper code. The message of the original error,
+// which includes stderr of failed commands, is kept. Status errors are
+// returned as is.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if err == vstorage.ErrNoCredentials {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	code := codes.Internal
+	switch e := err.(type) {
+	case *ploop.Err:
+		for c, grpcCode := range ploopCodes {
+			if ploop.IsError(e, c) {
+				code = grpcCode
+				break
+			}
+		}
+	case *vstorage.CmdError:
+		if c, ok := vstorageCodes[e.Op]; ok {
+			code = c
+		}
+	default:
+		if c, ok := errnoCodes[errno(err)]; ok {
+			code = c
+		}
+	}
+
+	return status.Error(code, err.Error())
+}
+
+// errno extracts an error number from errors of the os package.
+func errno(err error) syscall.Errno {
+	switch e := err.(type) {
+	case syscall.Errno:
+		return e
+	case *os.PathError:
+		return errno(e.Err)
+	case *os.LinkError:
+		return errno(e.Err)
+	case *os.SyscallError:
+		return errno(e.Err)
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/kolyshkin/goploop-cli"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/avagin/csi-vstorage/pkg/virtuozzo-storage/vstorage"
+)
+
+func TestToStatus(t *testing.T) {
+	assert.NoError(t, toStatus(nil))
+
+	err := status.Error(codes.NotFound, "fake")
+	assert.Equal(t, err, toStatus(err))
+
+	err = toStatus(errors.New("fake"))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Contains(t, err.Error(), "fake")
+}
+
+func TestToStatusFileErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := os.Stat(filepath.Join(dir, "fake"))
+	assert.Equal(t, codes.NotFound, status.Code(toStatus(err)))
+
+	err = os.Mkdir(dir, 0755)
+	assert.Equal(t, codes.AlreadyExists, status.Code(toStatus(err)))
+
+	err = &os.PathError{Op: "write", Path: dir, Err: syscall.ENOSPC}
+	assert.Equal(t, codes.ResourceExhausted, status.Code(toStatus(err)))
+
+	err = &os.SyscallError{Syscall: "statfs", Err: syscall.ENOTCONN}
+	assert.Equal(t, codes.Unavailable, status.Code(toStatus(err)))
+}
+
+func TestToStatusVstorageErrors(t *testing.T) {
+	err := toStatus(&vstorage.CmdError{
+		Op:     vstorage.OpAuth,
+		Name:   "stor1",
+		Err:    errors.New("exit status 1"),
+		Stderr: "Authentication failed",
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Contains(t, err.Error(), "Authentication failed")
+
+	err = toStatus(&vstorage.CmdError{Op: vstorage.OpMount, Name: "stor1", Err: errors.New("exit status 1")})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	err = toStatus(&vstorage.CmdError{Op: vstorage.OpRevoke, Name: "stor1", Err: errors.New("exit status 1")})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+// ploopError returns an error of the ploop tool which exits with code and
+// prints stderr.
+func ploopError(t *testing.T, code int, stderr string) error {
+	dir := t.TempDir()
+	msg := filepath.Join(dir, "stderr")
+	script := fmt.Sprintf("#!/bin/sh\ncat %s >&2\nexit %d\n", msg, code)
+	if err := ioutil.WriteFile(msg, []byte(stderr), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ploop"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	return ploop.UmountByDevice("/dev/ploop100")
+}
+
+func TestToStatusPloopErrors(t *testing.T) {
+	tests := []struct {
+		code   int
+		stderr string
+		want   codes.Code
+	}{
+		{ploop.E_PLOOPINUSE, "Image is used by another ploop device", codes.FailedPrecondition},
+		{ploop.E_EBUSY, "Device or resource busy", codes.FailedPrecondition},
+		{ploop.E_LOCK, "Failed to lock DiskDescriptor.xml", codes.Aborted},
+		{ploop.E_FLOCK, "Can't lock root.hds", codes.Aborted},
+		{ploop.E_ABORT, "Operation aborted", codes.Aborted},
+		{ploop.E_FALLOCATE, "fallocate: No space left on device", codes.ResourceExhausted},
+		{ploop.E_NOSNAP, "Can't find snapshot by uuid", codes.NotFound},
+		{ploop.E_PARAM, "Incorrect size", codes.InvalidArgument},
+		{ploop.E_MOUNT, "Can't mount file system", codes.Internal},
+	}
+	for _, tc := range tests {
+		err := ploopError(t, tc.code, tc.stderr)
+		assert.True(t, ploop.IsError(err, tc.code), ploop.ErrCodes[tc.code])
+
+		err = toStatus(err)
+		assert.Equal(t, tc.want, status.Code(err), ploop.ErrCodes[tc.code])
+		assert.Contains(t, err.Error(), tc.stderr)
+	}
+}
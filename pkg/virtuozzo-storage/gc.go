@@ -0,0 +1,371 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"encoding/xml"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/avagin/csi-vstorage/pkg/csi-common"
+	"github.com/avagin/csi-vstorage/pkg/virtuozzo-storage/vstorage"
+)
+
+// Image directories which aren't used by any volume are removed only when
+// they are older than orphanGracePeriod, so images of volumes which are
+// being created right now are never touched.
+const orphanGracePeriod = time.Hour
+
+var (
+	// found by the last pass of the garbage collector
+	gcPendingDeletions = expvar.NewInt("vstorage_gc_pending_deletions")
+	gcOrphans          = expvar.NewInt("vstorage_gc_orphan_images")
+	// totals since the driver is started
+	gcDeletionsFinished = expvar.NewInt("vstorage_gc_deletions_finished_total")
+	gcOrphansRemoved    = expvar.NewInt("vstorage_gc_orphan_images_removed_total")
+	gcErrors            = expvar.NewInt("vstorage_gc_errors_total")
+)
+
+// garbageCollector periodically looks through directories of volumes in
+// clusters mounted by the controller. It finishes deletions of volumes which
+// have been interrupted after they were renamed to <volumeID>.deleted and
+// removes image directories which aren't used by any volume or snapshot. In
+// the dry-run mode it only reports what it would do.
+type garbageCollector struct {
+	interval time.Duration
+	dryRun   bool
+	locks    *csicommon.VolumeLocks
+	dirs     *volumeDirs
+	clusters *vstorage.MountManager
+}
+
+// volumeDirs are volumePath and deltasPath directories of volumes which the
+// controller has handled, by their cluster mounts. Other directories of a
+// cluster can be used by someone else, so the garbage collector doesn't
+// touch them. Directories of a StorageClass become known with the first
+// request for one of its volumes, including retries of interrupted
+// requests.
+type volumeDirs struct {
+	mux sync.Mutex
+	// volumePaths by deltasPaths by cluster mounts
+	dirs map[string]map[string]map[string]bool
+}
+
+func newVolumeDirs() *volumeDirs {
+	return &volumeDirs{dirs: map[string]map[string]map[string]bool{}}
+}
+
+func (d *volumeDirs) add(vol *volumeID) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	mount := vol.mountPath()
+	if d.dirs[mount] == nil {
+		d.dirs[mount] = map[string]map[string]bool{}
+	}
+	if d.dirs[mount][vol.deltasPath] == nil {
+		d.dirs[mount][vol.deltasPath] = map[string]bool{}
+	}
+	d.dirs[mount][vol.deltasPath][vol.volumePath] = true
+}
+
+// get returns known deltasPath directories in a cluster mount with
+// volumePath directories which share them, they are relative to the mount.
+func (d *volumeDirs) get(mount string) map[string][]string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	dirs := map[string][]string{}
+	for deltas, paths := range d.dirs[mount] {
+		for p := range paths {
+			dirs[deltas] = append(dirs[deltas], p)
+		}
+		sort.Strings(dirs[deltas])
+	}
+	return dirs
+}
+
+// volumePaths returns known volumePath directories in a cluster mount
+func (d *volumeDirs) volumePaths(mount string) []string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	seen := map[string]bool{}
+	dirs := []string{}
+	for _, paths := range d.dirs[mount] {
+		for p := range paths {
+			if !seen[p] {
+				seen[p] = true
+				dirs = append(dirs, p)
+			}
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// volumePathDirs returns absolute paths of directories dirs in a cluster
+// mount.
+func volumePathDirs(mount string, dirs []string) []string {
+	paths := []string{}
+	for _, dir := range dirs {
+		paths = append(paths, filepath.Join(mount, dir))
+	}
+	return paths
+}
+
+func (gc *garbageCollector) run() {
+	glog.Infof("GC: interval %v, dry run %v", gc.interval, gc.dryRun)
+	for {
+		gc.collect()
+		time.Sleep(gc.interval)
+	}
+}
+
+func (gc *garbageCollector) collect() {
+	mounts, err := servedClusters(gc.clusters)
+	if err != nil {
+		glog.Errorf("GC: unable to list clusters: %v", err)
+		gcErrors.Add(1)
+		return
+	}
+
+	pending, orphans := int64(0), int64(0)
+	for _, mount := range mounts {
+		dirs := gc.dirs.get(mount)
+		if len(dirs) == 0 {
+			continue
+		}
+		p, o, err := gc.collectCluster(mount, dirs)
+		if err != nil {
+			glog.Errorf("GC: unable to scan %s: %v", mount, err)
+			gcErrors.Add(1)
+		}
+		pending += p
+		orphans += o
+	}
+	gcPendingDeletions.Set(pending)
+	gcOrphans.Set(orphans)
+}
+
+// collectCluster handles directories of volumes in one cluster and returns
+// numbers of deletions and orphan image directories which are left. dirs
+// are volumePath directories by their deltasPath. Only entries right in
+// these directories are considered, as the driver creates them there.
+func (gc *garbageCollector) collectCluster(mount string, dirs map[string][]string) (int64, int64, error) {
+	deleted := []string{}
+	images := map[string]string{}
+	used := map[string]bool{}
+	creating := map[string]bool{}
+
+	// volumes, snapshots and volumes which are being created or deleted
+	// keep their images in use
+	markUsed := func(p string) error {
+		files, err := ploopImages(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// not a ploop volume or removed while we are
+				// looking through the directory
+				return nil
+			}
+			return err
+		}
+		for _, f := range files {
+			if !filepath.IsAbs(f) {
+				f = filepath.Join(p, f)
+			}
+			used[filepath.Dir(f)] = true
+		}
+		return nil
+	}
+
+	volumePaths := map[string]bool{}
+	for deltas, paths := range dirs {
+		for _, dir := range paths {
+			volumePaths[dir] = true
+		}
+
+		entries, err := ioutil.ReadDir(filepath.Join(mount, deltas))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, 0, err
+		}
+		for _, e := range entries {
+			if e.IsDir() && strings.HasSuffix(e.Name(), imageSuffix) {
+				images[filepath.Join(mount, deltas, e.Name())] = deltas
+			}
+		}
+	}
+
+	for dir := range volumePaths {
+		entries, err := ioutil.ReadDir(filepath.Join(mount, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, 0, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			name := e.Name()
+			p := filepath.Join(mount, dir, name)
+			switch {
+			case strings.HasSuffix(name, imageSuffix):
+				continue
+			case strings.HasSuffix(name, snapshotsSuffix):
+				snapshots, err := ioutil.ReadDir(p)
+				if err != nil && !os.IsNotExist(err) {
+					return 0, 0, err
+				}
+				for _, snap := range snapshots {
+					if err := markUsed(filepath.Join(p, snap.Name())); err != nil {
+						return 0, 0, err
+					}
+				}
+				continue
+			case strings.HasSuffix(name, deletedSuffix):
+				deleted = append(deleted, p)
+			case strings.HasSuffix(name, creatingSuffix):
+				creating[strings.TrimSuffix(name, creatingSuffix)] = true
+			}
+			if err := markUsed(p); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	paths := []string{}
+	for dir := range volumePaths {
+		paths = append(paths, dir)
+	}
+	sort.Strings(paths)
+	paths = volumePathDirs(mount, paths)
+
+	pending := int64(0)
+	for _, p := range deleted {
+		if !gc.finishDeletion(mount, p, paths) {
+			pending++
+		}
+	}
+
+	orphans := int64(0)
+	for p, deltas := range images {
+		if used[p] || creating[strings.TrimSuffix(filepath.Base(p), imageSuffix)] {
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil || time.Since(info.ModTime()) < orphanGracePeriod {
+			continue
+		}
+		// images can still belong to a volume whose metadata can't be
+		// read, they are only reported then
+		if owner := imageOwner(mount, dirs[deltas], p); owner != "" {
+			glog.Warningf("GC: %s isn't used by any volume, but %s exists", p, owner)
+			orphans++
+			continue
+		}
+		if !gc.removeOrphan(p) {
+			orphans++
+		}
+	}
+
+	return pending, orphans, nil
+}
+
+// imageOwner returns an entry of a volume which an image directory can
+// belong to, if there is one in any of volumePath directories which share
+// the deltasPath directory of the images.
+func imageOwner(mount string, volumePaths []string, imageDir string) string {
+	name := strings.TrimSuffix(filepath.Base(imageDir), imageSuffix)
+	for _, dir := range volumePaths {
+		for _, suffix := range []string{"", deletedSuffix, snapshotsSuffix} {
+			p := filepath.Join(mount, dir, name+suffix)
+			if _, err := os.Lstat(p); err == nil || !os.IsNotExist(err) {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// finishDeletion removes a volume which has been renamed to
+// <volumeID>.deleted and reports whether it's gone. Its images are kept
+// while volumes or snapshots in dirs use them.
+func (gc *garbageCollector) finishDeletion(mount, p string, dirs []string) bool {
+	if gc.dryRun {
+		glog.Infof("GC: %s is an interrupted deletion", p)
+		return false
+	}
+
+	vol := volumeIDFromPath(mount, p)
+	if !gc.locks.TryAcquire(vol.String()) {
+		// DeleteVolume is in progress
+		return false
+	}
+	defer gc.locks.Release(vol.String())
+
+	glog.Infof("GC: finish deletion of %s", p)
+	if err := removeDeletedPloop(p, vol.imageDir(mount), dirs); err != nil {
+		glog.Errorf("GC: unable to remove %s: %v", p, err)
+		gcErrors.Add(1)
+		return false
+	}
+	gcDeletionsFinished.Add(1)
+	return true
+}
+
+// removeOrphan removes an image directory which isn't used by any volume
+// and reports whether it's gone.
+func (gc *garbageCollector) removeOrphan(p string) bool {
+	if gc.dryRun {
+		glog.Warningf("GC: %s isn't used by any volume", p)
+		return false
+	}
+
+	glog.Warningf("GC: remove %s, it isn't used by any volume", p)
+	if err := os.RemoveAll(p); err != nil {
+		glog.Errorf("GC: unable to remove %s: %v", p, err)
+		gcErrors.Add(1)
+		return false
+	}
+	gcOrphansRemoved.Add(1)
+	return true
+}
+
+// ploopImages returns image files from DiskDescriptor.xml of a ploop volume
+// or a snapshot in ploopPath.
+func ploopImages(ploopPath string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	v := ParallelsDiskImage{}
+	if err := xml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return v.Images, nil
+}
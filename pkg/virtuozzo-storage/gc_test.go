@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/avagin/csi-vstorage/pkg/csi-common"
+)
+
+func writeDiskDescriptor(t *testing.T, ploopPath string, images ...string) {
+	files := ""
+	for _, f := range images {
+		files += fmt.Sprintf("<Storage><Image><File>%s</File></Image></Storage>", f)
+	}
+	dd := fmt.Sprintf("<Parallels_disk_image><StorageData>%s</StorageData></Parallels_disk_image>", files)
+	assert.NoError(t, os.MkdirAll(ploopPath, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(ploopPath, "DiskDescriptor.xml"), []byte(dd), 0644))
+}
+
+func makeOrphan(t *testing.T, p string) {
+	assert.NoError(t, os.MkdirAll(p, 0755))
+	old := time.Now().Add(-2 * orphanGracePeriod)
+	assert.NoError(t, os.Chtimes(p, old, old))
+}
+
+// directories of volumes in testCluster, two volume directories share the
+// same directory of images
+var testDirs = map[string][]string{"deltas": {"volumes", "volumes2"}}
+
+func testCluster(t *testing.T) string {
+	mount := t.TempDir()
+
+	// a volume and its snapshot which use the same images
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/pvc-1"), filepath.Join(mount, "deltas/pvc-1.image/root.hds"))
+	writeDiskDescriptor(t, filepath.Join(mount, "volumes/pvc-1.snapshots/snap-1"), filepath.Join(mount, "deltas/pvc-1.image/root.hds"))
+	makeOrphan(t, filepath.Join(mount, "deltas/pvc-1.image"))
+
+	// images which are left after the volume has been removed
+	makeOrphan(t, filepath.Join(mount, "deltas/pvc-2.image"))
+	// images of a volume which is being created
+	makeOrphan(t, filepath.Join(mount, "deltas/pvc-3.image"))
+	assert.NoError(t, os.MkdirAll(filepath.Join(mount, "volumes/pvc-3.creating"), 0755))
+	// a new directory which may be used by a volume being created
+	assert.NoError(t, os.MkdirAll(filepath.Join(mount, "deltas/pvc-4.image"), 0755))
+
+	// a deletion which has been interrupted after ploop-volume delete
+	assert.NoError(t, os.MkdirAll(filepath.Join(mount, "volumes/pvc-5.deleted"), 0755))
+
+	// directories of someone else
+	makeOrphan(t, filepath.Join(mount, "other/pvc-6.image"))
+	assert.NoError(t, os.MkdirAll(filepath.Join(mount, "other/pvc-7.deleted"), 0755))
+	makeOrphan(t, filepath.Join(mount, "volumes/nested/pvc-8.image"))
+
+	// images whose volumes can't be read are only reported
+	makeOrphan(t, filepath.Join(mount, "deltas/pvc-9.image"))
+	assert.NoError(t, os.MkdirAll(filepath.Join(mount, "volumes/pvc-9"), 0755))
+	makeOrphan(t, filepath.Join(mount, "deltas/pvc-10.image"))
+	assert.NoError(t, os.MkdirAll(filepath.Join(mount, "volumes2/pvc-10.snapshots"), 0755))
+
+	return mount
+}
+
+func TestGarbageCollector(t *testing.T) {
+	mount := testCluster(t)
+	gc := &garbageCollector{locks: csicommon.NewVolumeLocks()}
+
+	pending, orphans, err := gc.collectCluster(mount, testDirs)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pending)
+	assert.Equal(t, int64(2), orphans)
+
+	for _, p := range []string{"volumes/pvc-1", "volumes/pvc-1.snapshots/snap-1", "deltas/pvc-1.image",
+		"deltas/pvc-3.image", "volumes/pvc-3.creating", "deltas/pvc-4.image",
+		"other/pvc-6.image", "other/pvc-7.deleted", "volumes/nested/pvc-8.image",
+		"deltas/pvc-9.image", "deltas/pvc-10.image"} {
+		assert.True(t, exists(filepath.Join(mount, p)), p)
+	}
+	for _, p := range []string{"deltas/pvc-2.image", "volumes/pvc-5.deleted"} {
+		assert.False(t, exists(filepath.Join(mount, p)), p)
+	}
+}
+
+func TestGarbageCollectorDryRun(t *testing.T) {
+	mount := testCluster(t)
+	gc := &garbageCollector{dryRun: true, locks: csicommon.NewVolumeLocks()}
+
+	pending, orphans, err := gc.collectCluster(mount, testDirs)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), pending)
+	assert.Equal(t, int64(3), orphans)
+	for _, p := range []string{"deltas/pvc-2.image", "volumes/pvc-5.deleted"} {
+		assert.True(t, exists(filepath.Join(mount, p)), p)
+	}
+}
+
+func TestGarbageCollectorSkipsLockedVolumes(t *testing.T) {
+	mount := testCluster(t)
+	locks := csicommon.NewVolumeLocks()
+	gc := &garbageCollector{locks: locks}
+
+	vol := volumeIDFromPath(mount, filepath.Join(mount, "volumes/pvc-5.deleted"))
+	assert.True(t, locks.TryAcquire(vol.String()))
+
+	pending, _, err := gc.collectCluster(mount, testDirs)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), pending)
+	assert.True(t, exists(filepath.Join(mount, "volumes/pvc-5.deleted")))
+}
+
+func TestVolumeDirs(t *testing.T) {
+	dirs := newVolumeDirs()
+	dirs.add(newVolumeID("pvc-1", map[string]string{"clusterName": "stor1", "volumePath": "volumes", "deltasPath": "deltas"}))
+	dirs.add(newVolumeID("pvc-2", map[string]string{"clusterName": "stor1", "volumePath": "volumes"}))
+	dirs.add(newVolumeID("pvc-3", map[string]string{"clusterName": "stor2"}))
+
+	dirs.add(newVolumeID("pvc-4", map[string]string{"clusterName": "stor1", "volumePath": "volumes2", "deltasPath": "deltas"}))
+
+	assert.Equal(t, map[string][]string{"deltas": {"volumes", "volumes2"}, "volumes": {"volumes"}}, dirs.get(workingDir+"stor1"))
+	assert.Equal(t, map[string][]string{"": {""}}, dirs.get(workingDir+"stor2"))
+	assert.Empty(t, dirs.get(workingDir+"stor3"))
+}
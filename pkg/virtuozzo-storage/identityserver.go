@@ -0,0 +1,46 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/avagin/csi-vstorage/pkg/csi-common"
+	"github.com/avagin/csi-vstorage/pkg/virtuozzo-storage/vstorage"
+)
+
+type identityServer struct {
+	*csicommon.DefaultIdentityServer
+	clusters *vstorage.MountManager
+}
+
+// Probe reports the plugin as not ready while there are cluster mounts
+// which are broken and can't be mounted again.
+func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if broken := ids.clusters.Broken(); len(broken) != 0 {
+		glog.Errorf("Broken cluster mounts: %s", strings.Join(broken, ", "))
+		return &csi.ProbeResponse{
+			Ready: wrapperspb.Bool(false),
+		}, nil
+	}
+	return ids.DefaultIdentityServer.Probe(ctx, req)
+}
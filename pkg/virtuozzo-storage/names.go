@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Names of volumes, snapshots and clusters become names of files and
+// directories, so they are limited to a safe set of characters. It doesn't
+// include separators of volume and snapshot IDs.
+const maxNameLen = 128
+
+var (
+	nameRe       = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	unsafeNameRe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+// Suffixes of directories which the driver keeps next to volumes
+var reservedSuffixes = []string{imageSuffix, deletedSuffix, snapshotsSuffix, creatingSuffix, stagedSuffix}
+
+func validateName(name string) error {
+	if len(name) > maxNameLen || !nameRe.MatchString(name) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid name: %q", name))
+	}
+	for _, s := range reservedSuffixes {
+		if strings.HasSuffix(name, s) {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid name: %q", name))
+		}
+	}
+	return nil
+}
+
+// validateClusterName checks a cluster name, clusters are mounted in
+// workingDir next to the directory with node states.
+func validateClusterName(name string) error {
+	if name == "mounts" {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid cluster name: %q", name))
+	}
+	return validateName(name)
+}
+
+// validatePath checks a directory which is relative to a cluster mount and
+// makes sure that it can't point outside the mount.
+func validatePath(p string) error {
+	if p == "" {
+		return nil
+	}
+	if path.IsAbs(p) || path.Clean(p) != p || strings.ContainsRune(p, 0) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid path: %q", p))
+	}
+	for _, e := range strings.Split(p, "/") {
+		if e == ".." {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid path: %q", p))
+		}
+	}
+	return nil
+}
+
+// resolvePath makes sure that a directory p in a cluster mount doesn't lead
+// outside the mount through symlinks, validatePath checks only the path
+// itself. A directory which doesn't exist yet is checked by its nearest
+// existing parent, since it's going to be created there.
+func resolvePath(mount, p string) error {
+	root, err := filepath.EvalSymlinks(mount)
+	if err != nil {
+		return err
+	}
+	invalid := status.Error(codes.InvalidArgument, fmt.Sprintf("Path %q leads outside of %s", p, mount))
+
+	dir := filepath.Join(mount, p)
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if resolved != root && !strings.HasPrefix(resolved, root+"/") {
+				return invalid
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// a dangling symlink, directories would be created by it
+		if _, err := os.Lstat(dir); err == nil {
+			return invalid
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// diskName maps a name which comes from a CO to a name of a volume or a
+// snapshot on disk. Safe names are used as is, others are stripped of
+// unsafe characters and get a hash of the original name to stay unique.
+// The same name is always mapped to the same disk name, so requests stay
+// idempotent.
+func diskName(name string) string {
+	if validateName(name) == nil {
+		return name
+	}
+
+	safe := unsafeNameRe.ReplaceAllString(name, "_")
+	safe = strings.TrimLeft(safe, "_.-")
+	if len(safe) > maxNameLen/2 {
+		safe = safe[:maxNameLen/2]
+	}
+	if safe == "" {
+		safe = "volume"
+	}
+	h := sha256.Sum256([]byte(name))
+	return fmt.Sprintf("%s-%x", safe, h[:8])
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateName(t *testing.T) {
+	for _, n := range []string{"pvc-1", "a", "snapshot-1.2_3"} {
+		assert.NoError(t, validateName(n), n)
+	}
+	for _, n := range []string{
+		"", ".", "..", ".hidden", "-x", "a/b", "../../etc", "a b", "a@b", "a:b",
+		"pvc-1.image", "pvc-1.deleted", "pvc-1.snapshots", "pvc-1.creating", "pvc-1.staged",
+		strings.Repeat("a", maxNameLen+1),
+	} {
+		assert.Error(t, validateName(n), n)
+	}
+}
+
+func TestValidatePath(t *testing.T) {
+	for _, p := range []string{"", "kube", "kube/volumes", "a..b"} {
+		assert.NoError(t, validatePath(p), p)
+	}
+	for _, p := range []string{"/kube", "..", "../kube", "kube/../..", "kube/", "./kube", "kube//volumes", "a\x00b"} {
+		assert.Error(t, validatePath(p), p)
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	dir := t.TempDir()
+	mount := filepath.Join(dir, "stor1")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(mount, "kube"), outside} {
+		assert.NoError(t, os.MkdirAll(d, 0755))
+	}
+	assert.NoError(t, os.Symlink("kube", filepath.Join(mount, "inside")))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(mount, "escape")))
+	assert.NoError(t, os.Symlink("../..", filepath.Join(mount, "kube", "up")))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "missing"), filepath.Join(mount, "dangling")))
+
+	for _, p := range []string{"", "kube", "inside", "kube/volumes/new"} {
+		assert.NoError(t, resolvePath(mount, p), p)
+	}
+	for _, p := range []string{"escape", "escape/kube", "kube/up", "kube/up/outside", "dangling", "dangling/new"} {
+		assert.Error(t, resolvePath(mount, p), p)
+	}
+}
+
+func TestDiskName(t *testing.T) {
+	assert.Equal(t, "pvc-1", diskName("pvc-1"))
+
+	for _, n := range []string{
+		"../../etc", "..", "a b", "a@b", "pvc-1.image", "/", "",
+		strings.Repeat("x/", maxNameLen),
+	} {
+		d := diskName(n)
+		assert.NoError(t, validateName(d), n)
+		assert.Equal(t, d, diskName(n), n)
+	}
+
+	// different names are never mapped to the same one
+	assert.NotEqual(t, diskName("a b"), diskName("a_b"))
+	assert.NotEqual(t, diskName("a b"), diskName("a@b"))
+}
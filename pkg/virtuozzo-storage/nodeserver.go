@@ -17,16 +17,19 @@ limitations under the License.
 package vstorage
 
 import (
+	"context"
 	"crypto/md5"
-	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kolyshkin/goploop-cli"
-	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/util/mount"
@@ -39,74 +42,176 @@ import (
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	volumeLocks *csicommon.VolumeLocks
+	clusters    *vstorage.MountManager
+
+	// volumes which are staged on this node by their state directories
+	mux     sync.Mutex
+	volumes map[string]*stagedVolume
 }
 
 const workingDir = "/var/run/ploop-flexvol/"
 
-func prepareVstorage(clusterName, clusterPasswd string, mount string) error {
-	mounted, _ := vstorage.IsVstorage(mount)
-	if mounted {
-		return nil
-	}
+// Nodes refresh marks of their staged volumes every stagedMarkRefresh. A mark
+// which hasn't been refreshed for staleMarkTimeout has been left by a node
+// which is gone, and the controller removes it.
+const (
+	stagedMarkRefresh = 10 * time.Minute
+	staleMarkTimeout  = time.Hour
+)
 
-	// not mounted in proper place, prepare mount place and check other
-	// mounts
-	if err := os.MkdirAll(mount, 0700); err != nil {
-		return err
+// clusterMountPath returns the mount point of a cluster where a volume from
+// ploopPath is stored.
+func clusterMountPath(ploopPath string) (string, string) {
+	rel, err := filepath.Rel(workingDir, ploopPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", ""
 	}
+	name := strings.SplitN(rel, "/", 2)[0]
+	return name, filepath.Join(workingDir, name)
+}
 
-	v := vstorage.Vstorage{
-		Name: clusterName,
-	}
-	p, _ := v.Mountpoint()
-	if p != "" {
-		return syscall.Mount(p, mount, "", syscall.MS_BIND, "")
-	}
+// ploopStatePath returns a directory where the ploop volume from path is
+// mounted. We need to know a mount point to make snapshots, so we create our
+// mount point and then bind-mount it to staging paths.
+func ploopStatePath(path string) string {
+	return fmt.Sprintf("%s/mounts/ploop-%x", workingDir, md5.Sum([]byte(filepath.Clean(path))))
+}
 
-	if clusterPasswd == "" {
-		return errors.New("Please provide vstorage credentials")
+// stagingLink returns a symlink which points to the state directory of a
+// volume staged in stagingPath.
+func stagingLink(stagingPath string) string {
+	return fmt.Sprintf("%s/mounts/kube-%x", workingDir, md5.Sum([]byte(filepath.Clean(stagingPath))))
+}
+
+// markStaged records on a cluster that a volume in ploopPath is staged on
+// nodeID, so the controller doesn't delete it. It reports whether the mark
+// has been created.
+func markStaged(ploopPath, nodeID string) (bool, error) {
+	dir := ploopPath + stagedSuffix
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, diskName(nodeID)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
 	}
+	return true, f.Close()
+}
 
-	if err := v.Auth(clusterPasswd); err != nil {
+func unmarkStaged(ploopPath, nodeID string) error {
+	dir := ploopPath + stagedSuffix
+	if err := os.Remove(filepath.Join(dir, diskName(nodeID))); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	if err := v.Mount(mount); err != nil {
+	// fails if other nodes have staged the volume
+	os.Remove(dir)
+	return nil
+}
+
+// refreshStaged updates the time of the mark of nodeID. A mark which has
+// been removed isn't created again, the volume is being unstaged.
+func refreshStaged(ploopPath, nodeID string) error {
+	now := time.Now()
+	err := os.Chtimes(filepath.Join(ploopPath+stagedSuffix, diskName(nodeID)), now, now)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-
 	return nil
 }
 
-func mountPloop(target, path string, volume *ploop.Ploop, readonly bool) (string, error) {
-	target = filepath.Clean(target)
+// stagedNodes returns nodes which have staged a volume in ploopPath. Stale
+// marks of nodes which are gone are removed.
+func stagedNodes(ploopPath string) ([]string, error) {
+	dir := ploopPath + stagedSuffix
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	nodes := []string{}
+	for _, e := range entries {
+		if age := time.Since(e.ModTime()); age > staleMarkTimeout {
+			glog.Warningf("Remove the mark of %s on %s, it hasn't been refreshed for %v", ploopPath, e.Name(), age)
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		nodes = append(nodes, e.Name())
+	}
+	if len(nodes) == 0 && len(entries) != 0 {
+		os.Remove(dir)
+	}
+	return nodes, nil
+}
+
+// mountPloop mounts a ploop volume in its state directory. If block is
+// set, only the ploop device is attached and its file system isn't mounted.
+func mountPloop(path string, volume *ploop.Ploop, mp ploop.MountParam, block bool) (string, error) {
 	path = filepath.Clean(path)
 
-	statePath := fmt.Sprintf("%s/mounts/ploop-%x", workingDir, md5.Sum([]byte(path)))
+	statePath := ploopStatePath(path)
 	mntPath := fmt.Sprintf("%s/mnt", statePath)
 
-	if err := os.MkdirAll(mntPath, 0700); err != nil {
+	dir := statePath
+	if !block {
+		mp.Target = mntPath
+		dir = mntPath
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
 		return "", err
 	}
-	mp := ploop.MountParam{Target: mntPath, Readonly: readonly}
 
-	_, err := volume.Mount(&mp)
+	dev, err := volume.Mount(&mp)
 	if err != nil {
 		os.Remove(mntPath)
 		os.Remove(statePath)
 		return "", err
 	}
 
+	// remember which volume is mounted here to be able to resize it and
+	// which device is used to publish it as a block device
+	links := map[string]string{
+		"ploop": path,
+		"dev":   dev,
+	}
+	for name, dst := range links {
+		if err := os.Symlink(dst, fmt.Sprintf("%s/%s", statePath, name)); err != nil {
+			umountPloop(statePath)
+			return "", err
+		}
+	}
+
 	return statePath, nil
 }
 
 func umountPloop(statePath string) error {
 	mountPath := fmt.Sprintf("%s/mnt", statePath)
-	if err := ploop.UmountByMount(mountPath); err != nil {
-		return err
+	devLink := fmt.Sprintf("%s/dev", statePath)
+	ploopLink := fmt.Sprintf("%s/ploop", statePath)
+
+	if _, err := os.Stat(mountPath); err == nil {
+		if err := ploop.UmountByMount(mountPath); err != nil {
+			return err
+		}
+	} else {
+		dev, err := os.Readlink(devLink)
+		if err != nil {
+			return err
+		}
+		if err := ploop.UmountByDevice(dev); err != nil {
+			return err
+		}
 	}
 
-	if err := os.Remove(mountPath); err != nil {
-		return fmt.Errorf("Unable to remove %s: %v", mountPath, err)
+	for _, p := range []string{ploopLink, devLink, mountPath} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Unable to remove %s: %v", p, err)
+		}
 	}
 
 	if err := os.Remove(statePath); err != nil {
@@ -116,8 +221,198 @@ func umountPloop(statePath string) error {
 	return nil
 }
 
-func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+// expandStagedPloop grows a ploop volume which is staged in stagingPath on
+// this node, its file system is resized online.
+func expandStagedPloop(stagingPath string, bytes uint64) (uint64, error) {
+	statePath, err := os.Readlink(stagingLink(stagingPath))
+	if err != nil {
+		return 0, err
+	}
+
+	ploopPath, err := os.Readlink(fmt.Sprintf("%s/ploop", statePath))
+	if err != nil {
+		return 0, err
+	}
+
+	return resizePloop(ploopPath, bytes)
+}
+
+// ploopStats describes usage and health of a ploop volume staged on this
+// node. A block volume has no file system, only the size of its device is
+// known.
+type ploopStats struct {
+	info     ploop.FSInfoData
+	block    bool
+	size     uint64
+	abnormal bool
+	message  string
+}
+
+// stagedPloopPath returns a directory with ploop metadata of a volume which
+// is staged in stagingPath.
+func stagedPloopPath(stagingPath string) (string, error) {
+	statePath, err := os.Readlink(stagingLink(stagingPath))
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(fmt.Sprintf("%s/ploop", statePath))
+}
+
+// publishedPloopPath returns an image of a volume which is mounted in path
+func publishedPloopPath(path string) (string, error) {
+	mounts, err := mount.New("").List()
+	if err != nil {
+		return "", err
+	}
+	return publishedPloop(filepath.Join(workingDir, "mounts"), path, mounts)
+}
+
+// getStagedPloopStats collects statistics of the inner file system of a
+// staged ploop volume. The volume is reported as abnormal if its ploop
+// device has gone.
+func getStagedPloopStats(ploopPath string) (*ploopStats, error) {
+	dd := filepath.Join(ploopPath, "DiskDescriptor.xml")
+
+	volume, err := ploop.Open(dd)
+	if err != nil {
+		return nil, err
+	}
+	defer volume.Close()
+
+	if m, err := volume.IsMounted(); err != nil || !m {
+		message := fmt.Sprintf("Ploop device of %s is not found", ploopPath)
+		if err != nil {
+			message = fmt.Sprintf("%s: %v", message, err)
+		}
+		return &ploopStats{abnormal: true, message: message}, nil
+	}
+
+	statePath := ploopStatePath(ploopPath)
+	if _, err := os.Stat(filepath.Join(statePath, "mnt")); os.IsNotExist(err) {
+		dev, err := os.Readlink(filepath.Join(statePath, "dev"))
+		if err != nil {
+			return nil, err
+		}
+		size, err := deviceSize(sysBlockDir, dev)
+		if err != nil {
+			return nil, err
+		}
+		return &ploopStats{block: true, size: size}, nil
+	}
+
+	info, err := ploop.FSInfo(dd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ploopStats{info: info}, nil
+}
+
+// prepareMountPoint creates a mount point if it doesn't exist and reports
+// whether something is already mounted there.
+func prepareMountPoint(target string) (bool, error) {
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(target)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		if err := os.MkdirAll(target, 0750); err != nil {
+			return false, err
+		}
+		notMnt = true
+	}
+	return !notMnt, nil
+}
+
+// prepareDeviceFile creates a file to bind-mount a block device on if it
+// doesn't exist and reports whether something is already mounted there.
+func prepareDeviceFile(target string) (bool, error) {
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(target)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+			return false, err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, 0640)
+		if err != nil {
+			return false, err
+		}
+		f.Close()
+		notMnt = true
+	}
+	return !notMnt, nil
+}
+
+// checkPublished checks that source is what is already published in target
+// and that it's published with the same access mode. Otherwise the target is
+// used by another volume or the volume is published with other options, it
+// is reported with AlreadyExists.
+func checkPublished(source, target string, readonly, block bool) error {
+	var src, dst syscall.Stat_t
+	if err := syscall.Stat(source, &src); err != nil {
+		return err
+	}
+	if err := syscall.Stat(target, &dst); err != nil {
+		return err
+	}
+
+	// a file system is bind-mounted from its root, a block device is
+	// bind-mounted from its device file
+	same := src.Dev == dst.Dev && src.Ino == dst.Ino
+	if block {
+		same = src.Rdev == dst.Rdev
+	}
+	if !same {
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("%s is already used by another volume", target))
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(target, &fs); err != nil {
+		return err
+	}
+	// ST_RDONLY is equal to MS_RDONLY
+	if (fs.Flags&syscall.MS_RDONLY != 0) != readonly {
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("Volume is already published in %s with another access mode", target))
+	}
+	return nil
+}
+
+// stagedDevice returns the ploop device of a block volume which is staged
+// in stagingPath.
+func stagedDevice(stagingPath string) (string, error) {
+	statePath, err := os.Readlink(stagingLink(stagingPath))
+	if err != nil {
+		return "", fmt.Errorf("Volume isn't staged in %s: %v", stagingPath, err)
+	}
+	return os.Readlink(fmt.Sprintf("%s/dev", statePath))
+}
 
+// nodeVolumeID parses the ID of a volume in a node request, so requests are
+// serialized by the same ID whatever form of it they come with. A legacy ID
+// is completed by secrets or the volume context, and requests without them
+// find the volume by paths where it's staged or published.
+func (ns *nodeServer) nodeVolumeID(id string, location map[string]string, paths ...string) (*volumeID, error) {
+	vol, err := parseVolumeID(id, location)
+	if err == nil || status.Code(err) == codes.NotFound {
+		return vol, err
+	}
+	for _, p := range paths {
+		ploopPath, ok := ns.lookupVolume(p)
+		if !ok {
+			continue
+		}
+		if _, mount := clusterMountPath(ploopPath); mount != "" {
+			if v := volumeIDFromPath(mount, ploopPath); v.name == id {
+				return v, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	// Check arguments
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
@@ -125,91 +420,307 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
-	if len(req.GetTargetPath()) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
 	}
 
-	glog.Infof("NodePublishVolume id %s target %s", req.GetTargetPath(), req.GetVolumeId())
+	secret := req.GetSecrets()
+	vol, err := parseVolumeID(req.GetVolumeId(), volumeLocation(secret, req.GetVolumeContext()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
 
-	targetPath := req.GetTargetPath()
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	unlock, err := ns.volumeLocks.Lock(vol.String())
 	if err != nil {
-		if os.IsNotExist(err) {
-			if err := os.MkdirAll(targetPath, 0750); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
+	}
+	defer unlock()
+
+	glog.Infof("NodeStageVolume id %s staging %s", req.GetVolumeId(), req.GetStagingTargetPath())
+
+	if t := req.GetVolumeCapability().GetMount().GetFsType(); !isSupportedFsType(t) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Unsupported file system type: %s", t))
+	}
+
+	stagingPath := filepath.Clean(req.GetStagingTargetPath())
+	mntLink := stagingLink(stagingPath)
+	block := req.GetVolumeCapability().GetBlock() != nil
+	if block {
+		// a block volume is staged when its device is attached
+		if _, err := os.Lstat(mntLink); err == nil {
+			return &csi.NodeStageVolumeResponse{}, nil
+		}
+	} else {
+		mounted, err := prepareMountPoint(stagingPath)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		if mounted {
+			return &csi.NodeStageVolumeResponse{}, nil
+		}
+	}
+
+	// the cluster is used until the volume is unstaged
+	clusterMount := vol.mountPath()
+	path := vol.ploopPath(clusterMount)
+	if err := ns.clusters.Acquire(vol.cluster, secret["clusterPassword"], clusterMount, path); err != nil {
+		return nil, toStatus(err)
+	}
+	// mounted is set if the volume is mounted by this call, a volume which
+	// is already staged in another path is left mounted on errors and it
+	// holds its cluster only once
+	staged, mounted := false, false
+	defer func() {
+		if !staged || !mounted {
+			ns.clusters.Release(clusterMount, path)
+		}
+	}()
+	if err := vol.resolve(clusterMount); err != nil {
+		return nil, toStatus(err)
+	}
+
+	volume, err := ploop.Open(filepath.Join(path, "DiskDescriptor.xml"))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	defer volume.Close()
+
+	nodeID := ns.Driver.GetNodeID()
+	marked, err := markStaged(path, nodeID)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	defer func() {
+		if marked && !staged {
+			if err := unmarkStaged(path, nodeID); err != nil {
+				glog.Errorf("Unable to unmark %s: %v", path, err)
 			}
-			notMnt = true
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
 		}
+	}()
+
+	stateDir := fmt.Sprintf("%s/mounts", workingDir)
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, toStatus(err)
 	}
 
-	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
+	statePath := ploopStatePath(path)
+	mntPath := fmt.Sprintf("%s/mnt", statePath)
+	if m, _ := volume.IsMounted(); !m {
+		mp := ploop.MountParam{
+			Data: strings.Join(req.GetVolumeCapability().GetMount().GetMountFlags(), ","),
+		}
+		if statePath, err = mountPloop(path, &volume, mp, block); err != nil {
+			return nil, toStatus(err)
+		}
+		mounted = true
+	} else if _, err := os.Stat(statePath); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, "Ploop volume already mounted")
 	}
 
-	mo := req.GetVolumeCapability().GetMount().GetMountFlags()
-	if req.GetReadonly() {
-		mo = append(mo, "ro")
+	if err := os.Symlink(statePath, mntLink); err != nil {
+		if mounted {
+			umountPloop(statePath)
+		}
+		return nil, toStatus(err)
+	}
+
+	if block {
+		staged = true
+		ns.trackStaged(statePath, stagingPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if err := syscall.Mount(mntPath, stagingPath, "", syscall.MS_BIND, ""); err != nil {
+		os.Remove(mntLink)
+		if mounted {
+			umountPloop(statePath)
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Unable to bind mount %s -> %s: %v", mntPath, stagingPath, err))
 	}
 
-	readonly := req.GetReadonly()
-	secret := req.GetNodePublishSecrets()
-	cluster := secret["clusterName"]
-	passwd := secret["clusterPassword"]
+	staged = true
+	ns.trackStaged(statePath, stagingPath)
+	return &csi.NodeStageVolumeResponse{}, nil
+}
 
-	mount := filepath.Join(workingDir, cluster)
-	if err := prepareVstorage(cluster, passwd, mount); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
 	}
 
-	path := mount
-	if secret["volumePath"] != "" {
-		path = filepath.Join(path, secret["volumePath"])
+	// a volume which can't be found isn't staged here, its staging path is
+	// cleaned up anyway
+	key := req.GetVolumeId()
+	if vol, err := ns.nodeVolumeID(key, nil, req.GetStagingTargetPath()); err == nil {
+		key = vol.String()
 	}
-	path = filepath.Join(path, req.GetVolumeId())
-	volume, err := ploop.Open(filepath.Join(path, "DiskDescriptor.xml"))
+	unlock, err := ns.volumeLocks.Lock(key)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
-	defer volume.Close()
+	defer unlock()
 
-	target := targetPath
-	if m, _ := volume.IsMounted(); !m {
-		stateDir := fmt.Sprintf("%s/mounts", workingDir)
-		if err := os.MkdirAll(stateDir, 0700); err != nil {
-			return nil, err
+	stagingPath := filepath.Clean(req.GetStagingTargetPath())
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(stagingPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, toStatus(err)
+	}
+	if err == nil && !notMnt {
+		if err := mount.New("").Unmount(stagingPath); err != nil {
+			return nil, toStatus(err)
+		}
+	}
+
+	mntLink := stagingLink(stagingPath)
+	statePath, err := os.Readlink(mntLink)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, toStatus(err)
+	}
+
+	// the volume is found before its state is removed, and a previous call
+	// which has been interrupted after that leaves only the volume ID
+	ploopPath := ""
+	if statePath != "" {
+		ploopPath, _ = os.Readlink(fmt.Sprintf("%s/ploop", statePath))
+	}
+	if ploopPath == "" {
+		if vol, err := parseVolumeID(req.GetVolumeId(), nil); err == nil {
+			ploopPath = vol.ploopPath(vol.mountPath())
 		}
+	}
 
-		statePath, err := mountPloop(targetPath, path, &volume, readonly)
+	if statePath != "" {
+		// the volume stays mounted while it's staged in other paths, the
+		// link is removed last, so an interrupted call can be retried
+		links, err := stagingLinks(filepath.Join(workingDir, "mounts"), statePath)
 		if err != nil {
-			return nil, err
+			return nil, toStatus(err)
 		}
+		last := len(links) == 0 || len(links) == 1 && links[0] == filepath.Clean(mntLink)
+		if _, err := os.Stat(statePath); err == nil && last {
+			if err := umountPloop(statePath); err != nil {
+				return nil, toStatus(err)
+			}
+			ns.untrackStaged(statePath)
+		}
+		if err := os.Remove(mntLink); err != nil && !os.IsNotExist(err) {
+			return nil, toStatus(err)
+		}
+		ns.untrackStagingPath(statePath, stagingPath)
+	}
 
-		target = filepath.Clean(target)
+	if err := ns.releaseStaged(ploopPath); err != nil {
+		return nil, toStatus(err)
+	}
 
-		// We need to know a mount point to make snapshots, so
-		// we create our mount point and then bind-mount it to "target"
-		// If it's mounted, let's mount it!
-		mntLink := fmt.Sprintf("%s/kube-%x", stateDir, md5.Sum([]byte(target)))
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
 
-		//glog.Infof("Create symlink %s %s", statePath, mntLink)
-		if err := os.Symlink(statePath, mntLink); err != nil {
-			umountPloop(statePath)
-			return nil, err
+// releaseStaged removes the mark of this node and releases the cluster of a
+// volume in ploopPath which has been unstaged. Nothing is done while the
+// volume is still mounted on this node in another staging path.
+func (ns *nodeServer) releaseStaged(ploopPath string) error {
+	if ploopPath == "" {
+		return nil
+	}
+	if _, err := os.Stat(ploopStatePath(ploopPath)); err == nil {
+		return nil
+	}
+	if err := unmarkStaged(ploopPath, ns.Driver.GetNodeID()); err != nil {
+		return err
+	}
+	if _, mount := clusterMountPath(ploopPath); mount != "" {
+		ns.clusters.Release(mount, ploopPath)
+	}
+	return nil
+}
+
+// refreshMarks keeps marks of volumes which are staged on this node fresh
+// for the controller.
+func (ns *nodeServer) refreshMarks(interval time.Duration) {
+	for {
+		ns.mux.Lock()
+		paths := []string{}
+		for _, vol := range ns.volumes {
+			paths = append(paths, vol.ploopPath)
 		}
+		ns.mux.Unlock()
 
-		mntPath := fmt.Sprintf("%s/mnt", statePath)
-		if err := syscall.Mount(mntPath, targetPath, "", syscall.MS_BIND, ""); err != nil {
-			umountPloop(statePath)
-			os.Remove(mntLink)
-			return nil, fmt.Errorf("Unable to bind mount %s -> %s: %v", mntPath, target, err)
+		for _, p := range paths {
+			if err := refreshStaged(p, ns.Driver.GetNodeID()); err != nil {
+				glog.Errorf("Unable to refresh the mark of %s: %v", p, err)
+			}
 		}
+		time.Sleep(interval)
+	}
+}
+
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+
+	// Check arguments
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	vol, err := ns.nodeVolumeID(req.GetVolumeId(), volumeLocation(req.GetSecrets(), req.GetVolumeContext()), req.GetStagingTargetPath())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	unlock, err := ns.volumeLocks.Lock(vol.String())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
+	glog.Infof("NodePublishVolume id %s target %s", req.GetVolumeId(), req.GetTargetPath())
+
+	targetPath := req.GetTargetPath()
+	stagingPath := filepath.Clean(req.GetStagingTargetPath())
+	source := stagingPath
+
+	var mounted bool
+	block := req.GetVolumeCapability().GetBlock() != nil
+	if block {
+		source, err = stagedDevice(stagingPath)
+		if err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		mounted, err = prepareDeviceFile(targetPath)
 	} else {
+		mounted, err = prepareMountPoint(targetPath)
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if mounted {
+		if err := checkPublished(source, targetPath, req.GetReadonly(), block); err != nil {
+			return nil, toStatus(err)
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
 
-		return nil, fmt.Errorf("Ploop volume already mounted")
+	if err := mount.New("").Mount(source, targetPath, "", options); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Unable to bind mount %s -> %s: %v", source, targetPath, err))
 	}
+	ns.trackPublished(stagingPath, targetPath)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -223,48 +734,159 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	// a volume which can't be found isn't published here, its target is
+	// cleaned up anyway
+	key := req.GetVolumeId()
+	if vol, err := ns.nodeVolumeID(key, nil, req.GetTargetPath()); err == nil {
+		key = vol.String()
+	}
+	unlock, err := ns.volumeLocks.Lock(key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	targetPath := req.GetTargetPath()
 	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
-
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, status.Error(codes.NotFound, "Targetpath not found")
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
+			// already unpublished
+			return &csi.NodeUnpublishVolumeResponse{}, nil
 		}
+		return nil, toStatus(err)
 	}
 	if notMnt {
-		return nil, status.Error(codes.NotFound, "Volume not mounted")
+		// a previous call has unmounted the volume, but it failed to
+		// remove the target
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return nil, toStatus(err)
+		}
+		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
 
-	err = util.UnmountPath(req.GetTargetPath(), mount.New(""))
+	err = util.UnmountPath(targetPath, mount.New(""))
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatus(err)
 	}
+	ns.untrackPublished(targetPath)
 
-	mount := targetPath
-	mntLink := fmt.Sprintf("%s/mounts/kube-%x", workingDir, md5.Sum([]byte(mount)))
-	statePath, err := os.Readlink(mntLink)
-	if err != nil {
-		return nil, err
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
 	}
 
-	//glog.Infof("Umount %s(%s)", statePath, mntLink)
-	if err := umountPloop(statePath); err != nil {
+	vol, err := ns.nodeVolumeID(req.GetVolumeId(), req.GetSecrets(), req.GetVolumePath(), req.GetStagingTargetPath())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	unlock, err := ns.volumeLocks.Lock(vol.String())
+	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	if err := os.Remove(mntLink); err != nil {
-		return nil, err
+	size, err := expandStagedPloop(req.GetStagingTargetPath(), uint64(req.GetCapacityRange().GetRequiredBytes()))
+	if err != nil && os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume %s isn't staged in %s", req.GetVolumeId(), req.GetStagingTargetPath()))
+	}
+	if err != nil {
+		return nil, toStatus(err)
 	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: int64(size)}, nil
 }
 
-func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return &csi.NodeUnstageVolumeResponse{}, nil
-}
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
 
-func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return &csi.NodeStageVolumeResponse{}, nil
+	// The volume isn't locked: stats are only read, and concurrent requests
+	// to publish the volume mustn't fail with Aborted. Volumes are tracked
+	// by their mounts, the staging path is optional and the mount table is
+	// looked through only if the volume path isn't known.
+	var err error
+	ploopPath, known := ns.lookupVolume(req.GetVolumePath())
+	if !known && len(req.GetStagingTargetPath()) != 0 {
+		ploopPath, err = stagedPloopPath(req.GetStagingTargetPath())
+	} else if !known {
+		ploopPath, err = publishedPloopPath(req.GetVolumePath())
+	}
+	if err != nil && os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume %s isn't mounted in %s", req.GetVolumeId(), req.GetVolumePath()))
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	// images of a volume can't be used after its cluster mount has been
+	// broken, even if the cluster is mounted again
+	if _, mount := clusterMountPath(ploopPath); mount != "" {
+		if err := ns.clusters.Health(mount, ploopPath); err != nil {
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: &csi.VolumeCondition{
+					Abnormal: true,
+					Message:  err.Error(),
+				},
+			}, nil
+		}
+	}
+
+	stats, err := getStagedPloopStats(ploopPath)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	condition := &csi.VolumeCondition{
+		Abnormal: stats.abnormal,
+		Message:  stats.message,
+	}
+	if stats.abnormal {
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+	}
+
+	if stats.block {
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Total: int64(stats.size),
+					Unit:  csi.VolumeUsage_BYTES,
+				},
+			},
+			VolumeCondition: condition,
+		}, nil
+	}
+
+	info := stats.info
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Available: int64(info.BlocksFree * info.BlockSize),
+				Total:     int64(info.Blocks * info.BlockSize),
+				Used:      int64((info.Blocks - info.BlocksFree) * info.BlockSize),
+				Unit:      csi.VolumeUsage_BYTES,
+			},
+			{
+				Available: int64(info.InodesFree),
+				Total:     int64(info.Inodes),
+				Used:      int64(info.Inodes - info.InodesFree),
+				Unit:      csi.VolumeUsage_INODES,
+			},
+		},
+		VolumeCondition: condition,
+	}, nil
 }
@@ -0,0 +1,72 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckPublished(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, checkPublished(dir, dir, false, false))
+
+	err := checkPublished(dir, t.TempDir(), false, false)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// the same volume, but it's published read-write
+	err = checkPublished(dir, dir, true, false)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	err = checkPublished("/dev/null", "/dev/zero", false, true)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestNodeVolumeID(t *testing.T) {
+	stagingPath := "/var/lib/kubelet/plugins/staging/a"
+	ns := &nodeServer{volumes: map[string]*stagedVolume{
+		"/state": {
+			ploopPath:    workingDir + "stor1/kube/pvc-1",
+			stagingPaths: map[string]bool{stagingPath: true},
+			targets:      map[string]bool{},
+		},
+	}}
+	id := "1:stor1:kube:pvc-1"
+
+	vol, err := ns.nodeVolumeID(id, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, id, vol.String())
+
+	// a legacy ID is completed by the location
+	vol, err = ns.nodeVolumeID("pvc-1", map[string]string{clusterNameKey: "stor1", volumePathKey: "kube"})
+	assert.NoError(t, err)
+	assert.Equal(t, id, vol.String())
+
+	// or by the volume staged in a path
+	vol, err = ns.nodeVolumeID("pvc-1", nil, "/target", stagingPath)
+	assert.NoError(t, err)
+	assert.Equal(t, id, vol.String())
+
+	_, err = ns.nodeVolumeID("pvc-2", nil, stagingPath)
+	assert.Error(t, err)
+
+	_, err = ns.nodeVolumeID("1:stor1", nil, stagingPath)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,408 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// Attached ploop devices and their images are listed here
+const sysBlockDir = "/sys/block"
+
+// stagedVolume is a ploop volume which is mounted on this node in its state
+// directory.
+type stagedVolume struct {
+	ploopPath    string
+	device       string
+	stagingPaths map[string]bool
+	targets      map[string]bool
+}
+
+func newStagedVolume(ploopPath, device string) *stagedVolume {
+	return &stagedVolume{
+		ploopPath:    ploopPath,
+		device:       device,
+		stagingPaths: map[string]bool{},
+		targets:      map[string]bool{},
+	}
+}
+
+// recoverNodeState reconciles state directories and staging links in
+// mountsDir with mounts and attached ploop devices after the plugin is
+// restarted. State of volumes which aren't mounted anymore and dangling
+// links are removed. Ploop devices of volumes from workingDir without
+// state are reported. It returns volumes which are staged on this node by
+// their state directories and volumes whose state has been removed.
+func recoverNodeState(mountsDir string, mounts []mount.MountPoint, sysBlock string) (map[string]*stagedVolume, []string, error) {
+	volumes := map[string]*stagedVolume{}
+	unstaged := []string{}
+
+	entries, err := ioutil.ReadDir(mountsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return volumes, unstaged, nil
+		}
+		return nil, nil, err
+	}
+
+	mounted := map[string]bool{}
+	for _, m := range mounts {
+		mounted[m.Path] = true
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "ploop-") {
+			continue
+		}
+		statePath := filepath.Join(mountsDir, e.Name())
+		mntPath := filepath.Join(statePath, "mnt")
+		ploopPath, _ := os.Readlink(filepath.Join(statePath, "ploop"))
+		dev, _ := os.Readlink(filepath.Join(statePath, "dev"))
+
+		attached := false
+		if _, err := os.Stat(mntPath); err == nil {
+			attached = mounted[mntPath]
+		} else if dev != "" {
+			// a block volume
+			_, err := os.Stat(filepath.Join(sysBlock, filepath.Base(dev)))
+			attached = err == nil
+		}
+		if !attached {
+			glog.Warningf("Remove stale state %s of %s", statePath, ploopPath)
+			if err := removeStaleState(statePath); err != nil {
+				glog.Errorf("Unable to remove %s: %v", statePath, err)
+			} else if ploopPath != "" {
+				unstaged = append(unstaged, ploopPath)
+			}
+			continue
+		}
+
+		vol := newStagedVolume(ploopPath, dev)
+		volumes[statePath] = vol
+		for _, p := range volumeMounts(vol, mounts) {
+			if p == mntPath {
+				continue
+			}
+			link := filepath.Join(mountsDir, filepath.Base(stagingLink(p)))
+			if l, err := os.Readlink(link); err == nil && filepath.Clean(l) == statePath {
+				vol.stagingPaths[p] = true
+			} else {
+				vol.targets[p] = true
+			}
+		}
+		glog.Infof("Recovered %s: device %s, staged in %v, published in %v",
+			ploopPath, dev, keys(vol.stagingPaths), keys(vol.targets))
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "kube-") {
+			continue
+		}
+		link := filepath.Join(mountsDir, e.Name())
+		statePath, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+		if _, ok := volumes[filepath.Clean(statePath)]; ok {
+			continue
+		}
+		glog.Warningf("Remove dangling link %s -> %s", link, statePath)
+		if err := os.Remove(link); err != nil {
+			glog.Errorf("Unable to remove %s: %v", link, err)
+		}
+	}
+
+	for dev, image := range leakedDevices(volumes, sysBlock) {
+		glog.Warningf("Ploop device %s with %s isn't used by any volume", dev, image)
+	}
+
+	return volumes, unstaged, nil
+}
+
+// removeStaleState removes a state directory of a volume which isn't
+// mounted. Unknown files are left in place.
+func removeStaleState(statePath string) error {
+	for _, name := range []string{"ploop", "dev", "mnt"} {
+		p := filepath.Join(statePath, name)
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(statePath)
+}
+
+// volumeMounts returns mount points of a volume. A file system is
+// bind-mounted from the first partition of a ploop device, a block volume
+// is bind-mounted from its device file.
+func volumeMounts(vol *stagedVolume, mounts []mount.MountPoint) []string {
+	var rdev uint64
+	var st syscall.Stat_t
+	if err := syscall.Stat(vol.device, &st); err == nil {
+		rdev = st.Rdev
+	}
+
+	paths := []string{}
+	for _, m := range mounts {
+		if m.Device == vol.device+"p1" {
+			paths = append(paths, m.Path)
+			continue
+		}
+		if rdev == 0 || m.Type != "devtmpfs" {
+			continue
+		}
+		if err := syscall.Stat(m.Path, &st); err == nil && st.Rdev == rdev && st.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+			paths = append(paths, m.Path)
+		}
+	}
+	return paths
+}
+
+// publishedPloop returns an image of a volume which is staged in a state
+// directory in mountsDir and mounted in path. It's used when a staging path
+// isn't known, the volume is found by its device like on recovery.
+func publishedPloop(mountsDir, path string, mounts []mount.MountPoint) (string, error) {
+	entries, err := ioutil.ReadDir(mountsDir)
+	if err != nil {
+		return "", err
+	}
+
+	path = filepath.Clean(path)
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "ploop-") {
+			continue
+		}
+		statePath := filepath.Join(mountsDir, e.Name())
+		ploopPath, err := os.Readlink(filepath.Join(statePath, "ploop"))
+		if err != nil {
+			continue
+		}
+		dev, err := os.Readlink(filepath.Join(statePath, "dev"))
+		if err != nil {
+			continue
+		}
+		for _, p := range volumeMounts(newStagedVolume(ploopPath, dev), mounts) {
+			if filepath.Clean(p) == path {
+				return ploopPath, nil
+			}
+		}
+	}
+	return "", &os.PathError{Op: "lookup", Path: path, Err: os.ErrNotExist}
+}
+
+// leakedDevices returns ploop devices with images from workingDir which
+// don't belong to any staged volume and their images. The base image of a
+// ploop device is reported in pdelta/0/image.
+func leakedDevices(volumes map[string]*stagedVolume, sysBlock string) map[string]string {
+	owned := map[string]bool{}
+	for _, vol := range volumes {
+		owned[filepath.Base(vol.device)] = true
+	}
+
+	entries, err := ioutil.ReadDir(sysBlock)
+	if err != nil {
+		return nil
+	}
+	leaked := map[string]string{}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "ploop") || owned[name] {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(sysBlock, name, "pdelta/0/image"))
+		if err != nil {
+			continue
+		}
+		image := strings.TrimSpace(string(data))
+		// other ploop devices are used by containers
+		if !strings.HasPrefix(image, filepath.Clean(workingDir)+"/") {
+			continue
+		}
+		leaked[fmt.Sprintf("/dev/%s", name)] = image
+	}
+	return leaked
+}
+
+// deviceSize returns the size of a block device in bytes, sysfs reports it
+// in 512-byte sectors.
+func deviceSize(sysBlock, dev string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sysBlock, filepath.Base(dev), "size"))
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse the size of %s: %v", dev, err)
+	}
+	return sectors * 512, nil
+}
+
+// recoverState rebuilds the state of volumes on this node when the plugin
+// is started.
+func (ns *nodeServer) recoverState() {
+	mounts, err := mount.New("").List()
+	if err != nil {
+		glog.Errorf("Unable to list mounts: %v", err)
+		return
+	}
+	volumes, unstaged, err := recoverNodeState(filepath.Join(workingDir, "mounts"), mounts, sysBlockDir)
+	if err != nil {
+		glog.Errorf("Unable to recover the node state: %v", err)
+		return
+	}
+
+	// staged volumes keep their clusters mounted
+	for _, vol := range volumes {
+		name, mount := clusterMountPath(vol.ploopPath)
+		if mount == "" {
+			continue
+		}
+		if err := ns.clusters.Acquire(name, "", mount, vol.ploopPath); err != nil {
+			glog.Errorf("Unable to acquire %s for %s: %v", mount, vol.ploopPath, err)
+		}
+	}
+
+	// marks of volumes which have been unmounted behind our back can be
+	// removed only if their clusters are still mounted, otherwise the
+	// controller removes them when they become stale. Nothing has acquired
+	// their clusters, so they are acquired only while marks are removed.
+	for _, p := range unstaged {
+		name, mount := clusterMountPath(p)
+		if mount == "" {
+			continue
+		}
+		if err := ns.clusters.Acquire(name, "", mount, p); err != nil {
+			glog.Warningf("Unable to acquire %s to unmark %s: %v", mount, p, err)
+			continue
+		}
+		if err := unmarkStaged(p, ns.Driver.GetNodeID()); err != nil {
+			glog.Errorf("Unable to unmark %s: %v", p, err)
+		}
+		ns.clusters.Release(mount, p)
+	}
+
+	ns.mux.Lock()
+	defer ns.mux.Unlock()
+	ns.volumes = volumes
+}
+
+func (ns *nodeServer) trackStaged(statePath, stagingPath string) {
+	statePath = filepath.Clean(statePath)
+	ploopPath, _ := os.Readlink(filepath.Join(statePath, "ploop"))
+	dev, _ := os.Readlink(filepath.Join(statePath, "dev"))
+
+	ns.mux.Lock()
+	defer ns.mux.Unlock()
+	vol, ok := ns.volumes[statePath]
+	if !ok {
+		vol = newStagedVolume(ploopPath, dev)
+		ns.volumes[statePath] = vol
+	}
+	vol.stagingPaths[stagingPath] = true
+}
+
+// untrackStaged forgets a volume which has been unmounted
+func (ns *nodeServer) untrackStaged(statePath string) {
+	ns.mux.Lock()
+	defer ns.mux.Unlock()
+	delete(ns.volumes, filepath.Clean(statePath))
+}
+
+// untrackStagingPath forgets a staging path of a volume which stays mounted
+// in other staging paths.
+func (ns *nodeServer) untrackStagingPath(statePath, stagingPath string) {
+	ns.mux.Lock()
+	defer ns.mux.Unlock()
+	if vol, ok := ns.volumes[filepath.Clean(statePath)]; ok {
+		delete(vol.stagingPaths, filepath.Clean(stagingPath))
+	}
+}
+
+// stagingLinks returns links in mountsDir of staging paths where a volume
+// with the state directory statePath is staged.
+func stagingLinks(mountsDir, statePath string) ([]string, error) {
+	entries, err := ioutil.ReadDir(mountsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	links := []string{}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "kube-") {
+			continue
+		}
+		link := filepath.Join(mountsDir, e.Name())
+		if l, err := os.Readlink(link); err == nil && filepath.Clean(l) == filepath.Clean(statePath) {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (ns *nodeServer) trackPublished(stagingPath, target string) {
+	statePath, err := os.Readlink(stagingLink(stagingPath))
+	if err != nil {
+		return
+	}
+
+	ns.mux.Lock()
+	defer ns.mux.Unlock()
+	if vol, ok := ns.volumes[filepath.Clean(statePath)]; ok {
+		vol.targets[filepath.Clean(target)] = true
+	}
+}
+
+func (ns *nodeServer) untrackPublished(target string) {
+	ns.mux.Lock()
+	defer ns.mux.Unlock()
+	for _, vol := range ns.volumes {
+		delete(vol.targets, filepath.Clean(target))
+	}
+}
+
+// lookupVolume returns an image of a staged volume which is mounted in path,
+// it's either a staging path or a target path.
+func (ns *nodeServer) lookupVolume(path string) (string, bool) {
+	path = filepath.Clean(path)
+	ns.mux.Lock()
+	defer ns.mux.Unlock()
+	for _, vol := range ns.volumes {
+		if vol.stagingPaths[path] || vol.targets[path] {
+			return vol.ploopPath, true
+		}
+	}
+	return "", false
+}
+
+func keys(m map[string]bool) []string {
+	s := []string{}
+	for k := range m {
+		s = append(s, k)
+	}
+	return s
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func makeState(t *testing.T, mountsDir, name, ploopPath, dev string, fs bool) string {
+	statePath := filepath.Join(mountsDir, name)
+	assert.NoError(t, os.MkdirAll(statePath, 0700))
+	if fs {
+		assert.NoError(t, os.Mkdir(filepath.Join(statePath, "mnt"), 0700))
+	}
+	assert.NoError(t, os.Symlink(ploopPath, filepath.Join(statePath, "ploop")))
+	assert.NoError(t, os.Symlink(dev, filepath.Join(statePath, "dev")))
+	return statePath
+}
+
+func TestRecoverNodeState(t *testing.T) {
+	mountsDir := t.TempDir()
+	sysBlock := t.TempDir()
+
+	// a staged and published file system
+	fsState := makeState(t, mountsDir, "ploop-1", "/mnt/stor1/pvc-1", "/dev/ploop100", true)
+	stagingPath := "/var/lib/kubelet/plugins/staging/pvc-1"
+	targetPath := "/var/lib/kubelet/pods/pod-1/volumes/pvc-1"
+	assert.NoError(t, os.Symlink(fsState, filepath.Join(mountsDir, filepath.Base(stagingLink(stagingPath)))))
+
+	// a staged block volume
+	blockState := makeState(t, mountsDir, "ploop-2", "/mnt/stor1/pvc-2", "/dev/ploop200", false)
+	assert.NoError(t, os.Mkdir(filepath.Join(sysBlock, "ploop200"), 0755))
+
+	// a volume which has been unmounted while the plugin wasn't running
+	staleState := makeState(t, mountsDir, "ploop-3", "/mnt/stor1/pvc-3", "/dev/ploop300", true)
+	danglingLink := filepath.Join(mountsDir, "kube-3")
+	assert.NoError(t, os.Symlink(staleState, danglingLink))
+
+	// an empty state directory
+	assert.NoError(t, os.Mkdir(filepath.Join(mountsDir, "ploop-4"), 0700))
+
+	mounts := []mount.MountPoint{
+		{Device: "/dev/sda1", Path: "/", Type: "ext4"},
+		{Device: "/dev/ploop100p1", Path: filepath.Join(fsState, "mnt"), Type: "ext4"},
+		{Device: "/dev/ploop100p1", Path: stagingPath, Type: "ext4"},
+		{Device: "/dev/ploop100p1", Path: targetPath, Type: "ext4"},
+	}
+
+	volumes, unstaged, err := recoverNodeState(mountsDir, mounts, sysBlock)
+	assert.NoError(t, err)
+	assert.Len(t, volumes, 2)
+	assert.Equal(t, []string{"/mnt/stor1/pvc-3"}, unstaged)
+
+	vol := volumes[fsState]
+	if assert.NotNil(t, vol) {
+		assert.Equal(t, "/mnt/stor1/pvc-1", vol.ploopPath)
+		assert.Equal(t, "/dev/ploop100", vol.device)
+		assert.Equal(t, map[string]bool{stagingPath: true}, vol.stagingPaths)
+		assert.Equal(t, map[string]bool{targetPath: true}, vol.targets)
+	}
+	vol = volumes[blockState]
+	if assert.NotNil(t, vol) {
+		assert.Equal(t, "/dev/ploop200", vol.device)
+	}
+
+	for _, p := range []string{staleState, danglingLink, filepath.Join(mountsDir, "ploop-4")} {
+		_, err := os.Lstat(p)
+		assert.True(t, os.IsNotExist(err), p)
+	}
+}
+
+func TestRecoverNodeStateNoState(t *testing.T) {
+	volumes, unstaged, err := recoverNodeState(filepath.Join(t.TempDir(), "mounts"), nil, t.TempDir())
+	assert.NoError(t, err)
+	assert.Empty(t, volumes)
+	assert.Empty(t, unstaged)
+}
+
+func TestPublishedPloop(t *testing.T) {
+	mountsDir := t.TempDir()
+	fsState := makeState(t, mountsDir, "ploop-1", "/mnt/stor1/pvc-1", "/dev/ploop100", true)
+	makeState(t, mountsDir, "ploop-2", "/mnt/stor1/pvc-2", "/dev/ploop200", true)
+	targetPath := "/var/lib/kubelet/pods/pod-1/volumes/pvc-1"
+
+	mounts := []mount.MountPoint{
+		{Device: "/dev/sda1", Path: "/", Type: "ext4"},
+		{Device: "/dev/ploop100p1", Path: filepath.Join(fsState, "mnt"), Type: "ext4"},
+		{Device: "/dev/ploop100p1", Path: targetPath, Type: "ext4"},
+	}
+
+	ploopPath, err := publishedPloop(mountsDir, targetPath+"/", mounts)
+	assert.NoError(t, err)
+	assert.Equal(t, "/mnt/stor1/pvc-1", ploopPath)
+
+	_, err = publishedPloop(mountsDir, "/var/lib/kubelet/pods/pod-2/volumes/pvc-2", mounts)
+	assert.True(t, os.IsNotExist(err))
+	_, err = publishedPloop(filepath.Join(mountsDir, "missing"), targetPath, mounts)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLeakedDevices(t *testing.T) {
+	sysBlock := t.TempDir()
+	images := map[string]string{
+		"ploop100": workingDir + "stor1/pvc-1.image/root.hds",
+		"ploop200": workingDir + "stor1/pvc-2.image/root.hds",
+		// a container
+		"ploop300": "/vz/private/101/root.hdd/root.hds",
+	}
+	for dev, image := range images {
+		dir := filepath.Join(sysBlock, dev, "pdelta/0")
+		assert.NoError(t, os.MkdirAll(dir, 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "image"), []byte(image+"\n"), 0644))
+	}
+	assert.NoError(t, os.Mkdir(filepath.Join(sysBlock, "sda"), 0755))
+
+	volumes := map[string]*stagedVolume{
+		"ploop-1": newStagedVolume(workingDir+"stor1/pvc-1", "/dev/ploop100"),
+	}
+	assert.Equal(t, map[string]string{
+		"/dev/ploop200": workingDir + "stor1/pvc-2.image/root.hds",
+	}, leakedDevices(volumes, sysBlock))
+}
+
+func TestStagingLinksOfTwoPaths(t *testing.T) {
+	mountsDir := t.TempDir()
+	statePath := makeState(t, mountsDir, "ploop-1", "/mnt/stor1/pvc-1", "/dev/ploop100", true)
+	otherState := makeState(t, mountsDir, "ploop-2", "/mnt/stor1/pvc-2", "/dev/ploop200", true)
+
+	// a volume is staged in two paths and another volume in one more
+	stagingPaths := []string{"/var/lib/kubelet/plugins/staging/a", "/var/lib/kubelet/plugins/staging/b"}
+	links := []string{}
+	for _, p := range stagingPaths {
+		link := filepath.Join(mountsDir, filepath.Base(stagingLink(p)))
+		assert.NoError(t, os.Symlink(statePath, link))
+		links = append(links, link)
+	}
+	assert.NoError(t, os.Symlink(otherState, filepath.Join(mountsDir, filepath.Base(stagingLink("/var/lib/kubelet/plugins/staging/c")))))
+
+	ns := &nodeServer{volumes: map[string]*stagedVolume{}}
+	for _, p := range stagingPaths {
+		ns.trackStaged(statePath, p)
+	}
+
+	found, err := stagingLinks(mountsDir, statePath)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, links, found)
+
+	// the volume stays staged in the second path when the first one is
+	// unstaged
+	assert.NoError(t, os.Remove(links[0]))
+	ns.untrackStagingPath(statePath, stagingPaths[0])
+	found, err = stagingLinks(mountsDir, statePath)
+	assert.NoError(t, err)
+	assert.Equal(t, links[1:], found)
+
+	_, ok := ns.lookupVolume(stagingPaths[0])
+	assert.False(t, ok)
+	ploopPath, ok := ns.lookupVolume(stagingPaths[1])
+	assert.True(t, ok)
+	assert.Equal(t, "/mnt/stor1/pvc-1", ploopPath)
+}
+
+func TestDeviceSize(t *testing.T) {
+	sysBlock := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(sysBlock, "ploop100"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(sysBlock, "ploop100/size"), []byte("2097152\n"), 0644))
+
+	size, err := deviceSize(sysBlock, "/dev/ploop100")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1)<<30, size)
+
+	_, err = deviceSize(sysBlock, "/dev/ploop200")
+	assert.True(t, os.IsNotExist(err))
+}
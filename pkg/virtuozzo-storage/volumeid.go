@@ -0,0 +1,225 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A volume ID has to point to its ploop image whatever secrets come with a
+// request: secrets can be changed after a volume is created and nodes can
+// get other secrets than the provisioner. So the ID carries the cluster
+// name, the paths and the name of a volume:
+//
+//	1:<cluster>:<volumePath>:<deltasPath>:<name>
+//
+// where all fields are query-escaped, so they never contain separators of
+// volume and snapshot IDs. IDs have to fit in maxIDLength, so deltasPath is
+// omitted when it's the same as volumePath:
+//
+//	1:<cluster>:<volumePath>:<name>
+//
+// IDs of volumes which were created by older versions of the driver are
+// plain names, their paths come from secrets.
+const (
+	volumeIDVersion = "1"
+	volumeIDSep     = ":"
+)
+
+// maxIDLength is the limit of volume and snapshot IDs in the CSI spec
+const maxIDLength = 128
+
+// Keys of secrets and of the volume context which describe where a volume
+// is located.
+const (
+	clusterNameKey = "clusterName"
+	volumePathKey  = "volumePath"
+	deltasPathKey  = "deltasPath"
+)
+
+type volumeID struct {
+	cluster    string
+	volumePath string
+	deltasPath string
+	name       string
+}
+
+// newVolumeID describes a volume called name in a cluster and a directory
+// from secret.
+func newVolumeID(name string, secret map[string]string) *volumeID {
+	v := &volumeID{
+		cluster:    secret[clusterNameKey],
+		volumePath: secret[volumePathKey],
+		deltasPath: secret[deltasPathKey],
+		name:       name,
+	}
+	if v.deltasPath == "" {
+		v.deltasPath = v.volumePath
+	}
+	return v
+}
+
+// volumeLocation completes secret with the location of a volume from its
+// volume context. CreateVolume puts the location into the context, so nodes
+// need secrets only to authenticate in a cluster.
+func volumeLocation(secret, volumeContext map[string]string) map[string]string {
+	location := map[string]string{}
+	for k, v := range secret {
+		location[k] = v
+	}
+	for _, k := range []string{clusterNameKey, volumePathKey, deltasPathKey} {
+		if v, ok := volumeContext[k]; ok {
+			location[k] = v
+		}
+	}
+	return location
+}
+
+// parseVolumeID decodes a volume ID. A legacy ID is a plain volume name, the
+// rest of its location is taken from secret. A malformed ID can't belong to
+// any volume, so NotFound is returned for it, and InvalidArgument is
+// returned if the ID points outside of a cluster mount.
+func parseVolumeID(id string, secret map[string]string) (*volumeID, error) {
+	malformed := status.Error(codes.NotFound, fmt.Sprintf("Malformed volume ID: %s", id))
+
+	var v *volumeID
+	if !strings.HasPrefix(id, volumeIDVersion+volumeIDSep) {
+		if id == "" || strings.Contains(id, volumeIDSep) {
+			return nil, malformed
+		}
+		v = newVolumeID(id, secret)
+	} else {
+		fields := strings.Split(id, volumeIDSep)
+		if len(fields) == 4 {
+			// deltasPath is the same as volumePath
+			fields = []string{fields[0], fields[1], fields[2], fields[2], fields[3]}
+		}
+		if len(fields) != 5 {
+			return nil, malformed
+		}
+		for i, f := range fields[1:] {
+			s, err := url.QueryUnescape(f)
+			if err != nil {
+				return nil, malformed
+			}
+			fields[i+1] = s
+		}
+		v = &volumeID{
+			cluster:    fields[1],
+			volumePath: fields[2],
+			deltasPath: fields[3],
+			name:       fields[4],
+		}
+		if v.name == "" {
+			return nil, malformed
+		}
+	}
+
+	if err := v.validate(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// validate makes sure that a volume is inside its cluster mount.
+func (v *volumeID) validate() error {
+	if v.cluster == "" {
+		return status.Error(codes.InvalidArgument, "clusterName isn't specified")
+	}
+	if err := validateClusterName(v.cluster); err != nil {
+		return err
+	}
+	if err := validatePath(v.volumePath); err != nil {
+		return err
+	}
+	if err := validatePath(v.deltasPath); err != nil {
+		return err
+	}
+	return validateName(v.name)
+}
+
+// resolve makes sure that the directories of a volume stay inside its
+// cluster mount when symlinks are followed.
+func (v *volumeID) resolve(mount string) error {
+	if err := resolvePath(mount, v.volumePath); err != nil {
+		return err
+	}
+	return resolvePath(mount, v.deltasPath)
+}
+
+func (v *volumeID) String() string {
+	fields := []string{
+		volumeIDVersion,
+		url.QueryEscape(v.cluster),
+		url.QueryEscape(v.volumePath),
+	}
+	if v.deltasPath != v.volumePath {
+		fields = append(fields, url.QueryEscape(v.deltasPath))
+	}
+	fields = append(fields, url.QueryEscape(v.name))
+	return strings.Join(fields, volumeIDSep)
+}
+
+// checkIDLength makes sure that an ID of a new volume or snapshot fits in
+// the limit of the CSI spec. Long paths and names have to be shortened by
+// users, IDs can't be changed after they are returned to the CO.
+func checkIDLength(id string) error {
+	if len(id) > maxIDLength {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("ID %s is longer than %d bytes", id, maxIDLength))
+	}
+	return nil
+}
+
+// volumeContext returns a copy of params with the location of a volume.
+func (v *volumeID) volumeContext(params map[string]string) map[string]string {
+	ctx := map[string]string{}
+	for k, val := range params {
+		ctx[k] = val
+	}
+	ctx[clusterNameKey] = v.cluster
+	ctx[volumePathKey] = v.volumePath
+	ctx[deltasPathKey] = v.deltasPath
+	return ctx
+}
+
+// mountPath returns a directory where the cluster of a volume is mounted.
+func (v *volumeID) mountPath() string {
+	return filepath.Join(workingDir, v.cluster)
+}
+
+// ploopPath returns a directory with ploop metadata of a volume.
+func (v *volumeID) ploopPath(mount string) string {
+	return path.Join(mount, v.volumePath, v.name)
+}
+
+// imageDir returns a directory with ploop images of a volume. It has the
+// .image suffix to handle the case when deltasPath == volumePath.
+func (v *volumeID) imageDir(mount string) string {
+	return path.Join(mount, v.deltasPath, v.name+imageSuffix)
+}
+
+// snapshotsDir returns a directory with snapshots of a volume.
+func (v *volumeID) snapshotsDir(mount string) string {
+	return path.Join(mount, v.volumePath, v.name+snapshotsSuffix)
+}
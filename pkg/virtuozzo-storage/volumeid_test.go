@@ -0,0 +1,175 @@
+/*
+Copyright 2018 Andrei Vagin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstorage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeIDRoundTrip(t *testing.T) {
+	secret := map[string]string{
+		"clusterName": "stor1",
+		"volumePath":  "kube/volumes",
+		"deltasPath":  "kube/deltas:1",
+	}
+	vol := newVolumeID("pvc-1", secret)
+
+	id := vol.String()
+	assert.NotContains(t, id, "/")
+	assert.NotContains(t, id, snapshotIDSep)
+
+	// the location has to come from the ID, not from secrets
+	parsed, err := parseVolumeID(id, map[string]string{"volumePath": "other"})
+	assert.NoError(t, err)
+	assert.Equal(t, vol, parsed)
+	assert.Equal(t, "/mnt/kube/volumes/pvc-1", parsed.ploopPath("/mnt"))
+	assert.Equal(t, "/mnt/kube/deltas:1/pvc-1.image", parsed.imageDir("/mnt"))
+}
+
+func TestLegacyVolumeID(t *testing.T) {
+	secret := map[string]string{
+		"clusterName": "stor1",
+		"volumePath":  "kube",
+	}
+	vol, err := parseVolumeID("pvc-1", secret)
+	assert.NoError(t, err)
+	assert.Equal(t, &volumeID{
+		cluster:    "stor1",
+		volumePath: "kube",
+		deltasPath: "kube",
+		name:       "pvc-1",
+	}, vol)
+}
+
+func TestMalformedVolumeID(t *testing.T) {
+	for _, id := range []string{
+		"",
+		"a:b",
+		"1:stor1:kube",
+		"1:stor1:kube:",
+		"1:stor1:kube:kube:",
+		"1:stor1:kube:kube:pvc:1",
+		"1:stor1:%zz:kube:pvc",
+	} {
+		_, err := parseVolumeID(id, nil)
+		assert.Equal(t, codes.NotFound, status.Code(err), id)
+	}
+}
+
+func TestUnsafeVolumeID(t *testing.T) {
+	secret := map[string]string{
+		"clusterName": "stor1",
+		"volumePath":  "kube",
+	}
+	for _, id := range []string{
+		"..",
+		"1:stor1:..%2Fetc:kube:pvc-1",
+		"1:stor1:kube:%2Fetc:pvc-1",
+		"1:mounts:kube:kube:pvc-1",
+		"1:..:kube:kube:pvc-1",
+		"1::kube:kube:pvc-1",
+		"1:stor1:kube:kube:pvc-1.image",
+	} {
+		_, err := parseVolumeID(id, secret)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), id)
+	}
+
+	_, err := parseVolumeID("pvc-1", map[string]string{"clusterName": "stor1", "volumePath": "../.."})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, _, err = parseSnapshotID("pvc-1@..", secret)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestSnapshotID(t *testing.T) {
+	vol := newVolumeID("pvc-1", map[string]string{"clusterName": "stor1", "volumePath": "kube"})
+
+	parsed, name, err := parseSnapshotID(makeSnapshotID(vol, "snap-1"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, vol, parsed)
+	assert.Equal(t, "snap-1", name)
+
+	parsed, name, err = parseSnapshotID("pvc-1@snap-1", map[string]string{"clusterName": "stor1", "volumePath": "kube"})
+	assert.NoError(t, err)
+	assert.Equal(t, "pvc-1", parsed.name)
+	assert.Equal(t, "kube", parsed.volumePath)
+	assert.Equal(t, "snap-1", name)
+
+	for _, id := range []string{"pvc-1", "@snap-1", "pvc-1@", "a:b@snap-1"} {
+		_, _, err := parseSnapshotID(id, nil)
+		assert.Error(t, err, id)
+	}
+}
+
+func TestVolumeLocation(t *testing.T) {
+	vol := newVolumeID("pvc-1", map[string]string{"clusterName": "stor1", "volumePath": "kube"})
+	ctx := vol.volumeContext(map[string]string{"vzsTier": "1"})
+	assert.Equal(t, "1", ctx["vzsTier"])
+
+	// a node secret has only credentials
+	secret := map[string]string{"clusterName": "other", "clusterPassword": "passwd"}
+	location := volumeLocation(secret, ctx)
+	assert.Equal(t, "passwd", location["clusterPassword"])
+
+	parsed, err := parseVolumeID("pvc-1", location)
+	assert.NoError(t, err)
+	assert.Equal(t, vol, parsed)
+}
+
+func TestCheckIDLength(t *testing.T) {
+	vol := newVolumeID("pvc-1", map[string]string{"clusterName": "stor1", "volumePath": "kube"})
+	assert.NoError(t, checkIDLength(vol.String()))
+
+	vol.volumePath = strings.Repeat("kubernetes/", 12)
+	err := checkIDLength(vol.String())
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestShortVolumeID(t *testing.T) {
+	vol := newVolumeID("pvc-1", map[string]string{"clusterName": "stor1", "volumePath": "kube"})
+	assert.Equal(t, "1:stor1:kube:pvc-1", vol.String())
+
+	// IDs with deltasPath are still accepted
+	parsed, err := parseVolumeID("1:stor1:kube:kube:pvc-1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, vol, parsed)
+	assert.Equal(t, vol.String(), parsed.String())
+
+	parsed, err = parseVolumeID(vol.String(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, vol, parsed)
+}
+
+func TestRealisticIDLength(t *testing.T) {
+	secret := map[string]string{"clusterName": "stor1", "volumePath": "kubernetes/volumes"}
+	vol := newVolumeID(diskName("pvc-0d6d8a4c-7fb2-4d2e-a7b1-5e3c0c9f6a11"), secret)
+	name := diskName("snapshot-8f14e45f-ceea-467a-9b2d-3c59f3c1b2de")
+
+	assert.NoError(t, checkIDLength(vol.String()))
+	id := makeSnapshotID(vol, name)
+	assert.NoError(t, checkIDLength(id))
+
+	parsed, snap, err := parseSnapshotID(id, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, vol, parsed)
+	assert.Equal(t, name, snap)
+}
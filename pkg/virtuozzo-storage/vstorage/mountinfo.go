@@ -0,0 +1,133 @@
+package vstorage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	vstorageFSType = "fuse.vstorage"
+	vstorageSource = "vstorage://"
+)
+
+// mountInfoPath is replaced in tests
+var mountInfoPath = "/proc/self/mountinfo"
+
+// MountInfo is an entry of /proc/self/mountinfo. Root is a directory of
+// the file system which is mounted in MountPoint, it isn't "/" for bind
+// mounts of subdirectories.
+type MountInfo struct {
+	ID         int
+	Parent     int
+	Root       string
+	MountPoint string
+	FSType     string
+	Source     string
+}
+
+// unescapeMountInfo replaces octal sequences like \040, which the kernel
+// uses for spaces, tabs, new lines and backslashes, with their characters.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(c))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// parseMountInfo parses entries in the format of /proc/self/mountinfo:
+//
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// Optional fields are terminated by a single hyphen.
+func parseMountInfo(r io.Reader) ([]MountInfo, error) {
+	out := []MountInfo{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, " ")
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("Unable to parse mountinfo line %q", line)
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse mount ID in %q: %v", line, err)
+		}
+		parent, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse parent ID in %q: %v", line, err)
+		}
+
+		out = append(out, MountInfo{
+			ID:         id,
+			Parent:     parent,
+			Root:       unescapeMountInfo(fields[3]),
+			MountPoint: unescapeMountInfo(fields[4]),
+			FSType:     unescapeMountInfo(fields[sep+1]),
+			Source:     unescapeMountInfo(fields[sep+2]),
+		})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func readMountInfo() ([]MountInfo, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts, err := parseMountInfo(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", mountInfoPath, err)
+	}
+	return mounts, nil
+}
+
+// isVstorageMount reports whether m is a mount of a whole cluster
+func (m *MountInfo) isVstorageMount(name string) bool {
+	return m.FSType == vstorageFSType && m.Source == vstorageSource+name && m.Root == "/"
+}
+
+// lookupMount returns the last mount in path, which hides all previous
+// ones, or nil if nothing is mounted there.
+func lookupMount(mounts []MountInfo, path string) *MountInfo {
+	path = filepath.Clean(path)
+	var mount *MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == path {
+			mount = &mounts[i]
+		}
+	}
+	return mount
+}
@@ -0,0 +1,106 @@
+package vstorage
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withMountInfo(path string) func() {
+	old := mountInfoPath
+	mountInfoPath = path
+	return func() { mountInfoPath = old }
+}
+
+func TestParseMountInfo(t *testing.T) {
+	f, err := os.Open("testdata/mountinfo")
+	assert.NoError(t, err)
+	defer f.Close()
+
+	mounts, err := parseMountInfo(f)
+	assert.NoError(t, err)
+	assert.Len(t, mounts, 11)
+	assert.Equal(t, MountInfo{
+		ID:         60,
+		Parent:     22,
+		Root:       "/",
+		MountPoint: "/vstorage/stor1",
+		FSType:     "fuse.vstorage",
+		Source:     "vstorage://stor1",
+	}, mounts[4])
+	assert.Equal(t, MountInfo{
+		ID:         63,
+		Parent:     45,
+		Root:       "/data dir",
+		MountPoint: "/var/run/my cluster",
+		FSType:     "fuse.vstorage",
+		Source:     "vstorage://my cluster",
+	}, mounts[7])
+}
+
+func TestParseMountInfoErrors(t *testing.T) {
+	for _, line := range []string{
+		"22 1 253:0 / / rw,relatime shared:1 xfs /dev/root rw",
+		"22 1 253:0 / / rw,relatime -",
+		"x 1 253:0 / / rw,relatime - xfs /dev/root rw",
+	} {
+		_, err := parseMountInfo(strings.NewReader(line))
+		assert.Error(t, err, line)
+	}
+}
+
+func TestUnescapeMountInfo(t *testing.T) {
+	assert.Equal(t, "/mnt/a b", unescapeMountInfo(`/mnt/a\040b`))
+	assert.Equal(t, "a\tb\nc\\d", unescapeMountInfo(`a\011b\012c\134d`))
+	assert.Equal(t, `a\09`, unescapeMountInfo(`a\09`))
+	assert.Equal(t, `a\04`, unescapeMountInfo(`a\04`))
+}
+
+func TestIsVstorage(t *testing.T) {
+	defer withMountInfo("testdata/mountinfo")()
+
+	for _, c := range []struct {
+		name, path string
+		expected   bool
+	}{
+		{"stor1", "/vstorage/stor1", true},
+		{"stor1", "/var/run/ploop-flexvol//stor1/", true},
+		{"my cluster", "/var/run/my cluster", true},
+		// another cluster
+		{"stor2", "/vstorage/stor1", false},
+		// a bind mount of /kubernetes of stor1
+		{"stor2", "/var/run/ploop-flexvol/stor2", false},
+		{"stor1", "/var/run/ploop-flexvol/stor2", false},
+		{"stor3", "/var/run/ploop-flexvol/stor3", false},
+		{"sshfs", "/mnt/sshfs", false},
+		{"stor1", "/vstorage", false},
+		{"stor1", "/", false},
+	} {
+		ok, err := IsVstorage(c.name, c.path)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, ok, c.path)
+	}
+}
+
+func TestMountpoint(t *testing.T) {
+	defer withMountInfo("testdata/mountinfo")()
+
+	for name, expected := range map[string]string{
+		"stor1":      "/vstorage/stor1",
+		"my cluster": "/var/run/my cluster",
+		"stor3":      "",
+		"stor":       "",
+	} {
+		v := Vstorage{Name: name}
+		p, err := v.Mountpoint()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, p, name)
+	}
+
+	defer withMountInfo("testdata/missing")()
+	v := Vstorage{Name: "stor1"}
+	_, err := v.Mountpoint()
+	assert.Error(t, err)
+}
@@ -0,0 +1,518 @@
+package vstorage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ErrNoCredentials is returned when a cluster has to be mounted, but its
+// password isn't known.
+var ErrNoCredentials = errors.New("Please provide vstorage credentials")
+
+// ErrMountTimeout is returned when a mount point doesn't respond in
+// MountTimeout.
+var ErrMountTimeout = errors.New("Mount point doesn't respond")
+
+// MountTimeout is how long a healthy cluster mount may take to respond
+const MountTimeout = 30 * time.Second
+
+// CheckMount checks that a file system mounted in where responds. statfs
+// is called in a separate goroutine, because it hangs if vstorage-mount
+// is stuck.
+func CheckMount(where string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		var buf syscall.Statfs_t
+		done <- syscall.Statfs(where, &buf)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return &os.PathError{Op: "statfs", Path: where, Err: err}
+		}
+		return nil
+	case <-time.After(timeout):
+		return &os.PathError{Op: "statfs", Path: where, Err: ErrMountTimeout}
+	}
+}
+
+// IsBroken reports whether err is returned for a FUSE mount which daemon
+// has died or hangs.
+func IsBroken(err error) bool {
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	}
+	return err == syscall.ENOTCONN || err == ErrMountTimeout
+}
+
+// Prepare makes a cluster available in where. If the cluster is already
+// mounted somewhere else, that mount is bind-mounted, otherwise the node is
+// authenticated with password and the cluster is mounted. A broken mount
+// is mounted again.
+func Prepare(name, password, where string) error {
+	err := CheckMount(where, MountTimeout)
+	if IsBroken(err) {
+		return Remount(name, where)
+	}
+	if err == nil {
+		if mounted, _ := IsVstorage(name, where); mounted {
+			return nil
+		}
+	}
+
+	// not mounted in proper place, prepare mount place and check other
+	// mounts
+	if err := os.MkdirAll(where, 0700); err != nil {
+		return err
+	}
+
+	v := Vstorage{
+		Name: name,
+	}
+	p, _ := v.Mountpoint()
+	if p != "" && CheckMount(p, MountTimeout) == nil {
+		return syscall.Mount(p, where, "", syscall.MS_BIND, "")
+	}
+
+	if password == "" {
+		return ErrNoCredentials
+	}
+
+	if err := v.Auth(password); err != nil {
+		return err
+	}
+	return v.Mount(where)
+}
+
+// Remount detaches a broken mount in where and mounts the cluster there
+// again. The node has been authenticated when the cluster was mounted for
+// the first time, so a password isn't needed. The mount isn't checked
+// again, because statfs hangs on it.
+func Remount(name, where string) error {
+	glog.Warningf("Detach broken cluster mount %s", where)
+	if err := syscall.Unmount(where, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("Unable to detach %s: %v", where, err)
+	}
+	v := Vstorage{
+		Name: name,
+	}
+	return v.Mount(where)
+}
+
+func unmount(where string) error {
+	if err := syscall.Unmount(where, 0); err != nil {
+		return err
+	}
+	return os.Remove(where)
+}
+
+// MountManager keeps track of users of cluster mounts. A cluster is
+// mounted when it's acquired for the first time and it's unmounted when
+// nobody has used it for the idle timeout.
+//
+// mux protects the state of mounts and is never held while a mount is
+// checked, mounted or unmounted, since that can hang on a broken mount.
+// These operations are serialized for each mount by its op mutex, which is
+// taken before mux.
+type MountManager struct {
+	mux     sync.Mutex
+	mounts  map[string]*clusterMount
+	idle    time.Duration
+	timeout time.Duration
+
+	// replaced in tests
+	mount   func(name, password, where string) error
+	remount func(name, where string) error
+	unmount func(where string) error
+	check   func(where string) error
+	now     func() time.Time
+}
+
+type clusterMount struct {
+	op sync.Mutex
+
+	name      string
+	users     map[string]int
+	idleSince time.Time
+
+	// pending counts Acquire calls which haven't finished yet, the mount
+	// isn't unmounted or forgotten while there are any
+	pending int
+	// checking is set while statfs of the mount hasn't returned, a new
+	// one isn't started until then
+	checking bool
+
+	// err is set while the mount is broken and can't be mounted again
+	err error
+	// affected are users which have been using the mount when it broke
+	affected map[string]bool
+}
+
+func newClusterMount(name string) *clusterMount {
+	return &clusterMount{name: name, users: map[string]int{}, affected: map[string]bool{}}
+}
+
+// MountState describes a cluster mount. IdleSince is zero while the mount
+// is used.
+type MountState struct {
+	Name      string
+	Path      string
+	Users     map[string]int
+	IdleSince time.Time
+	Error     string   `json:",omitempty"`
+	Affected  []string `json:",omitempty"`
+}
+
+// NewMountManager creates a manager which unmounts clusters after they have
+// been idle for idle.
+func NewMountManager(idle time.Duration) *MountManager {
+	return &MountManager{
+		mounts:  map[string]*clusterMount{},
+		idle:    idle,
+		timeout: MountTimeout,
+		mount:   Prepare,
+		remount: Remount,
+		unmount: unmount,
+		check: func(where string) error {
+			var buf syscall.Statfs_t
+			if err := syscall.Statfs(where, &buf); err != nil {
+				return &os.PathError{Op: "statfs", Path: where, Err: err}
+			}
+			return nil
+		},
+		now: time.Now,
+	}
+}
+
+// checkMount checks a mount in where like CheckMount. A statfs which hangs
+// is left running, and the mount is reported as broken without another
+// one until it returns.
+func (m *MountManager) checkMount(cm *clusterMount, where string) error {
+	timeout := &os.PathError{Op: "statfs", Path: where, Err: ErrMountTimeout}
+
+	m.mux.Lock()
+	if cm.checking {
+		m.mux.Unlock()
+		return timeout
+	}
+	cm.checking = true
+	m.mux.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := m.check(where)
+		m.mux.Lock()
+		cm.checking = false
+		m.mux.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(m.timeout):
+		return timeout
+	}
+}
+
+// Acquire makes sure that a cluster is mounted in where and adds user to
+// its users. A user can acquire a mount several times, it has to release it
+// as many times.
+func (m *MountManager) Acquire(name, password, where, user string) error {
+	m.mux.Lock()
+	cm, ok := m.mounts[where]
+	if !ok {
+		cm = newClusterMount(name)
+		m.mounts[where] = cm
+	}
+	cm.pending++
+	used := len(cm.users) != 0
+	m.mux.Unlock()
+
+	cm.op.Lock()
+	defer cm.op.Unlock()
+
+	// the mount is checked every time, it could be unmounted by someone
+	var err error
+	if used {
+		if err = m.checkMount(cm, where); IsBroken(err) {
+			m.mux.Lock()
+			cm.markBroken(where, err)
+			m.mux.Unlock()
+		}
+	}
+	if IsBroken(err) {
+		err = m.remount(name, where)
+	} else {
+		err = m.mount(name, password, where)
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	cm.pending--
+	if err != nil {
+		// a mount which has never been used is forgotten
+		if len(cm.users) == 0 && cm.pending == 0 && cm.idleSince.IsZero() {
+			delete(m.mounts, where)
+		}
+		return err
+	}
+	cm.err = nil
+	cm.users[user]++
+	cm.idleSince = time.Time{}
+	return nil
+}
+
+// Release removes user from users of a mount in where
+func (m *MountManager) Release(where, user string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	cm, ok := m.mounts[where]
+	if !ok || cm.users[user] == 0 {
+		glog.Errorf("%s doesn't use %s", user, where)
+		return
+	}
+	cm.users[user]--
+	if cm.users[user] == 0 {
+		delete(cm.users, user)
+		delete(cm.affected, user)
+	}
+	if len(cm.users) == 0 {
+		cm.idleSince = m.now()
+	}
+}
+
+// Adopt starts tracking a cluster which has been mounted in where before,
+// it's unmounted if nobody acquires it.
+func (m *MountManager) Adopt(name, where string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if _, ok := m.mounts[where]; ok {
+		return
+	}
+	cm := newClusterMount(name)
+	cm.idleSince = m.now()
+	m.mounts[where] = cm
+}
+
+// Hold adds user to users of a cluster mount in where only once, however
+// many times it's called, so the cluster isn't unmounted until user
+// releases it. A mount which isn't tracked yet is adopted.
+func (m *MountManager) Hold(name, where, user string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	cm, ok := m.mounts[where]
+	if !ok {
+		cm = newClusterMount(name)
+		m.mounts[where] = cm
+	}
+	if cm.users[user] == 0 {
+		cm.users[user] = 1
+	}
+	cm.idleSince = time.Time{}
+}
+
+// CheckHealth checks mounts which are used and mounts broken ones again,
+// mounts which have failed to be mounted again are retried.
+// Users of a broken mount are reported as affected until they release it,
+// because files which they have opened are not valid any more. Mounts are
+// checked in parallel, so one which hangs doesn't delay others.
+func (m *MountManager) CheckHealth() {
+	m.mux.Lock()
+	used := map[string]*clusterMount{}
+	for where, cm := range m.mounts {
+		if len(cm.users) != 0 {
+			used[where] = cm
+		}
+	}
+	m.mux.Unlock()
+
+	var wg sync.WaitGroup
+	for where, cm := range used {
+		wg.Add(1)
+		go func(where string, cm *clusterMount) {
+			defer wg.Done()
+			m.checkHealth(where, cm)
+		}(where, cm)
+	}
+	wg.Wait()
+}
+
+func (m *MountManager) checkHealth(where string, cm *clusterMount) {
+	cm.op.Lock()
+	defer cm.op.Unlock()
+
+	err := m.checkMount(cm, where)
+
+	m.mux.Lock()
+	if IsBroken(err) {
+		cm.markBroken(where, err)
+	} else if cm.err == nil {
+		m.mux.Unlock()
+		return
+	}
+	name := cm.name
+	m.mux.Unlock()
+
+	err = m.remount(name, where)
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if err != nil {
+		glog.Errorf("Unable to mount %s in %s again: %v", name, where, err)
+		cm.err = err
+		return
+	}
+	cm.err = nil
+}
+
+// markBroken remembers err until the mount is mounted again and marks all
+// current users as affected.
+func (cm *clusterMount) markBroken(where string, err error) {
+	cm.err = err
+	glog.Errorf("Cluster %s in %s is broken: %v", cm.name, where, err)
+	for user := range cm.users {
+		if !cm.affected[user] {
+			glog.Errorf("%s is affected by the broken mount %s", user, where)
+		}
+		cm.affected[user] = true
+	}
+}
+
+// Health returns an error if the mount in where is broken or if it has
+// been broken since user acquired it.
+func (m *MountManager) Health(where, user string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	cm, ok := m.mounts[where]
+	if !ok {
+		return nil
+	}
+	if cm.err != nil {
+		return fmt.Errorf("Cluster mount %s is broken: %v", where, cm.err)
+	}
+	if cm.affected[user] {
+		return fmt.Errorf("Cluster mount %s has been broken and mounted again, %s has to be staged again", where, user)
+	}
+	return nil
+}
+
+// Broken returns mount points which are broken and can't be mounted again
+func (m *MountManager) Broken() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	broken := []string{}
+	for where, cm := range m.mounts {
+		if cm.err != nil {
+			broken = append(broken, where)
+		}
+	}
+	sort.Strings(broken)
+	return broken
+}
+
+// UnmountIdle unmounts clusters which haven't been used for the idle
+// timeout and returns their mount points.
+func (m *MountManager) UnmountIdle() []string {
+	m.mux.Lock()
+	idle := map[string]*clusterMount{}
+	for where, cm := range m.mounts {
+		if m.isIdle(cm) {
+			idle[where] = cm
+		}
+	}
+	m.mux.Unlock()
+
+	unmounted := []string{}
+	for where, cm := range idle {
+		if m.unmountIdle(where, cm) {
+			unmounted = append(unmounted, where)
+		}
+	}
+	sort.Strings(unmounted)
+	return unmounted
+}
+
+func (m *MountManager) isIdle(cm *clusterMount) bool {
+	return len(cm.users) == 0 && cm.pending == 0 && m.now().Sub(cm.idleSince) >= m.idle
+}
+
+// unmountIdle unmounts a cluster in where unless it has been acquired
+// since it was found idle.
+func (m *MountManager) unmountIdle(where string, cm *clusterMount) bool {
+	cm.op.Lock()
+	defer cm.op.Unlock()
+
+	m.mux.Lock()
+	idle := m.mounts[where] == cm && m.isIdle(cm)
+	m.mux.Unlock()
+	if !idle {
+		return false
+	}
+
+	glog.Infof("Unmount idle cluster %s from %s", cm.name, where)
+	if err := m.unmount(where); err != nil {
+		glog.Errorf("Unable to unmount %s: %v", where, err)
+		return false
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	// Acquire mounts the cluster again
+	if cm.pending == 0 {
+		delete(m.mounts, where)
+	}
+	return true
+}
+
+// Run checks mounts and unmounts idle clusters every interval
+func (m *MountManager) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		m.CheckHealth()
+		m.UnmountIdle()
+	}
+}
+
+// State returns all tracked mounts sorted by their mount points
+func (m *MountManager) State() []MountState {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	state := []MountState{}
+	for where, cm := range m.mounts {
+		users := map[string]int{}
+		for u, n := range cm.users {
+			users[u] = n
+		}
+		s := MountState{
+			Name:      cm.name,
+			Path:      where,
+			Users:     users,
+			IdleSince: cm.idleSince,
+		}
+		if cm.err != nil {
+			s.Error = cm.err.Error()
+		}
+		for u := range cm.affected {
+			s.Affected = append(s.Affected, u)
+		}
+		sort.Strings(s.Affected)
+		state = append(state, s)
+	}
+	sort.Slice(state, func(i, j int) bool { return state[i].Path < state[j].Path })
+	return state
+}
@@ -0,0 +1,285 @@
+package vstorage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMounts struct {
+	mounted map[string]string
+	broken  map[string]bool
+	now     time.Time
+}
+
+func newTestManager(idle time.Duration) (*MountManager, *fakeMounts) {
+	f := &fakeMounts{
+		mounted: map[string]string{},
+		broken:  map[string]bool{},
+		now:     time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	m := NewMountManager(idle)
+	m.mount = func(name, password, where string) error {
+		if f.broken[where] {
+			return m.remount(name, where)
+		}
+		if _, ok := f.mounted[where]; ok {
+			return nil
+		}
+		if password == "" {
+			return ErrNoCredentials
+		}
+		f.mounted[where] = name
+		return nil
+	}
+	m.remount = func(name, where string) error {
+		delete(f.broken, where)
+		f.mounted[where] = name
+		return nil
+	}
+	m.check = func(where string) error {
+		if f.broken[where] {
+			return &os.PathError{Op: "statfs", Path: where, Err: syscall.ENOTCONN}
+		}
+		return nil
+	}
+	m.unmount = func(where string) error {
+		delete(f.mounted, where)
+		return nil
+	}
+	m.now = func() time.Time { return f.now }
+	return m, f
+}
+
+func TestMountManagerRefcount(t *testing.T) {
+	m, f := newTestManager(time.Minute)
+
+	assert.NoError(t, m.Acquire("c1", "secret", "/mnt/c1", "vol1"))
+	assert.NoError(t, m.Acquire("c1", "", "/mnt/c1", "vol1"))
+	assert.NoError(t, m.Acquire("c1", "", "/mnt/c1", "vol2"))
+	assert.Equal(t, map[string]string{"/mnt/c1": "c1"}, f.mounted)
+
+	m.Release("/mnt/c1", "vol1")
+	m.Release("/mnt/c1", "vol2")
+	f.now = f.now.Add(time.Hour)
+	assert.Empty(t, m.UnmountIdle())
+	assert.Contains(t, f.mounted, "/mnt/c1")
+
+	m.Release("/mnt/c1", "vol1")
+	assert.Empty(t, m.UnmountIdle())
+	f.now = f.now.Add(time.Minute)
+	assert.Equal(t, []string{"/mnt/c1"}, m.UnmountIdle())
+	assert.Empty(t, f.mounted)
+	assert.Empty(t, m.State())
+}
+
+func TestMountManagerAcquireIdle(t *testing.T) {
+	m, f := newTestManager(time.Minute)
+
+	assert.NoError(t, m.Acquire("c1", "secret", "/mnt/c1", "vol1"))
+	m.Release("/mnt/c1", "vol1")
+	f.now = f.now.Add(2 * time.Minute)
+	assert.NoError(t, m.Acquire("c1", "", "/mnt/c1", "vol2"))
+	assert.Empty(t, m.UnmountIdle())
+	assert.Contains(t, f.mounted, "/mnt/c1")
+}
+
+func TestMountManagerErrors(t *testing.T) {
+	m, f := newTestManager(time.Minute)
+
+	assert.Equal(t, ErrNoCredentials, m.Acquire("c1", "", "/mnt/c1", "vol1"))
+	assert.Empty(t, m.State())
+
+	// releasing an unknown user doesn't break the refcount
+	assert.NoError(t, m.Acquire("c1", "secret", "/mnt/c1", "vol1"))
+	m.Release("/mnt/c1", "vol2")
+	m.Release("/mnt/c2", "vol1")
+	f.now = f.now.Add(time.Hour)
+	assert.Empty(t, m.UnmountIdle())
+
+	m.Release("/mnt/c1", "vol1")
+	m.unmount = func(where string) error { return errors.New("busy") }
+	assert.Empty(t, m.UnmountIdle())
+	assert.Len(t, m.State(), 1)
+}
+
+func TestMountManagerAdopt(t *testing.T) {
+	m, f := newTestManager(time.Minute)
+	f.mounted["/mnt/c1"] = "c1"
+	f.mounted["/mnt/c2"] = "c2"
+
+	m.Adopt("c1", "/mnt/c1")
+	m.Adopt("c2", "/mnt/c2")
+	assert.NoError(t, m.Acquire("c2", "", "/mnt/c2", "vol1"))
+
+	f.now = f.now.Add(time.Minute)
+	assert.Equal(t, []string{"/mnt/c1"}, m.UnmountIdle())
+	assert.Equal(t, map[string]string{"/mnt/c2": "c2"}, f.mounted)
+}
+
+func TestMountManagerHold(t *testing.T) {
+	m, f := newTestManager(time.Minute)
+	f.mounted["/mnt/c2"] = "c2"
+
+	assert.NoError(t, m.Acquire("c1", "secret", "/mnt/c1", "vol1"))
+	m.Hold("c1", "/mnt/c1", "controller")
+	m.Hold("c1", "/mnt/c1", "controller")
+	m.Release("/mnt/c1", "vol1")
+	// a mount which isn't tracked is adopted
+	m.Hold("c2", "/mnt/c2", "controller")
+
+	f.now = f.now.Add(time.Hour)
+	assert.Empty(t, m.UnmountIdle())
+	assert.Equal(t, map[string]int{"controller": 1}, m.State()[0].Users)
+
+	m.Release("/mnt/c1", "controller")
+	f.now = f.now.Add(time.Minute)
+	assert.Equal(t, []string{"/mnt/c1"}, m.UnmountIdle())
+	assert.Equal(t, map[string]string{"/mnt/c2": "c2"}, f.mounted)
+}
+
+func TestMountManagerState(t *testing.T) {
+	m, f := newTestManager(time.Minute)
+
+	assert.NoError(t, m.Acquire("c2", "secret", "/mnt/c2", "vol1"))
+	assert.NoError(t, m.Acquire("c1", "secret", "/mnt/c1", "vol2"))
+	assert.NoError(t, m.Acquire("c1", "secret", "/mnt/c1", "vol2"))
+	m.Release("/mnt/c2", "vol1")
+
+	assert.Equal(t, []MountState{
+		{Name: "c1", Path: "/mnt/c1", Users: map[string]int{"vol2": 2}},
+		{Name: "c2", Path: "/mnt/c2", Users: map[string]int{}, IdleSince: f.now},
+	}, m.State())
+}
+
+func TestCheckMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-vstorage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, CheckMount(dir, time.Second))
+	err = CheckMount(filepath.Join(dir, "missing"), time.Second)
+	assert.True(t, os.IsNotExist(err))
+	assert.False(t, IsBroken(err))
+
+	assert.True(t, IsBroken(&os.PathError{Op: "statfs", Path: dir, Err: syscall.ENOTCONN}))
+	assert.True(t, IsBroken(&os.PathError{Op: "statfs", Path: dir, Err: ErrMountTimeout}))
+	assert.False(t, IsBroken(nil))
+}
+
+func TestMountManagerCheckHealth(t *testing.T) {
+	m, f := newTestManager(time.Minute)
+
+	assert.NoError(t, m.Acquire("c1", "secret", "/mnt/c1", "vol1"))
+	assert.NoError(t, m.Acquire("c2", "secret", "/mnt/c2", "vol2"))
+	m.CheckHealth()
+	assert.NoError(t, m.Health("/mnt/c1", "vol1"))
+
+	f.broken["/mnt/c1"] = true
+	m.CheckHealth()
+	assert.Empty(t, f.broken)
+	assert.Empty(t, m.Broken())
+	assert.Error(t, m.Health("/mnt/c1", "vol1"))
+	assert.NoError(t, m.Health("/mnt/c2", "vol2"))
+
+	// a new user isn't affected
+	assert.NoError(t, m.Acquire("c1", "", "/mnt/c1", "vol3"))
+	assert.NoError(t, m.Health("/mnt/c1", "vol3"))
+	assert.Equal(t, []string{"vol1"}, m.State()[0].Affected)
+
+	// vol1 is healthy when it's staged again
+	m.Release("/mnt/c1", "vol1")
+	assert.NoError(t, m.Acquire("c1", "", "/mnt/c1", "vol1"))
+	assert.NoError(t, m.Health("/mnt/c1", "vol1"))
+}
+
+func TestMountManagerRemountFails(t *testing.T) {
+	m, f := newTestManager(time.Minute)
+
+	assert.NoError(t, m.Acquire("c1", "secret", "/mnt/c1", "vol1"))
+	f.broken["/mnt/c1"] = true
+	remount := m.remount
+	m.remount = func(name, where string) error {
+		delete(f.mounted, where)
+		delete(f.broken, where)
+		return errors.New("vstorage-mount failed")
+	}
+	m.CheckHealth()
+	assert.Equal(t, []string{"/mnt/c1"}, m.Broken())
+	assert.Error(t, m.Health("/mnt/c1", "vol1"))
+	assert.Equal(t, "vstorage-mount failed", m.State()[0].Error)
+
+	// the mount isn't broken any more, but it's retried
+	m.remount = remount
+	m.CheckHealth()
+	assert.Empty(t, m.Broken())
+	assert.Contains(t, f.mounted, "/mnt/c1")
+	assert.Error(t, m.Health("/mnt/c1", "vol1"))
+}
+
+func TestMountManagerAcquireBroken(t *testing.T) {
+	m, f := newTestManager(time.Minute)
+
+	assert.NoError(t, m.Acquire("c1", "secret", "/mnt/c1", "vol1"))
+	f.broken["/mnt/c1"] = true
+	assert.NoError(t, m.Acquire("c1", "", "/mnt/c1", "vol2"))
+	assert.Empty(t, f.broken)
+	assert.Error(t, m.Health("/mnt/c1", "vol1"))
+	assert.NoError(t, m.Health("/mnt/c1", "vol2"))
+}
+
+func TestMountManagerHungCheck(t *testing.T) {
+	m, _ := newTestManager(time.Minute)
+	m.timeout = 200 * time.Millisecond
+	assert.NoError(t, m.Acquire("c1", "secret", "/mnt/c1", "vol1"))
+
+	started := make(chan struct{}, 1)
+	hang := make(chan struct{})
+	checks := int32(0)
+	m.check = func(where string) error {
+		if where != "/mnt/c1" {
+			return nil
+		}
+		atomic.AddInt32(&checks, 1)
+		started <- struct{}{}
+		<-hang
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.CheckHealth()
+		close(done)
+	}()
+	<-started
+
+	// other mounts and the state are available while statfs hangs
+	assert.NoError(t, m.Acquire("c2", "secret", "/mnt/c2", "vol2"))
+	assert.NoError(t, m.Health("/mnt/c1", "vol1"))
+	assert.Len(t, m.State(), 2)
+	select {
+	case <-done:
+		t.Fatal("CheckHealth has finished before the timeout")
+	default:
+	}
+
+	// the mount times out and a new statfs isn't started
+	<-done
+	assert.Error(t, m.Health("/mnt/c1", "vol1"))
+	m.CheckHealth()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&checks))
+
+	close(hang)
+	assert.Eventually(t, func() bool {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		return !m.mounts["/mnt/c1"].checking
+	}, time.Second, time.Millisecond)
+}
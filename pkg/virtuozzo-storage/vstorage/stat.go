@@ -0,0 +1,211 @@
+package vstorage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Stat is a summary of the "vstorage stat" output
+type Stat struct {
+	Allocatable uint64 // allocatable space
+	Free        uint64 // free raw space
+	Total       uint64 // total raw space
+	Replicas    int    // default number of replicas
+	CS          []CSStat
+}
+
+// CSStat describes one chunk server
+type CSStat struct {
+	ID     uint64
+	Status string
+	Tier   int
+	Space  uint64
+	Avail  uint64
+}
+
+// Space: [OK] allocatable 180GB of 200GB, free 190GB of 200GB
+var reSpace = regexp.MustCompile(`^\s*Space:.*allocatable\s+(\S+)\s+of\s+\S+,\s+free\s+(\S+)\s+of\s+(\S+)`)
+
+// Replication:  3 norm,  2 limit
+var reReplication = regexp.MustCompile(`^\s*Replication:\s+(\d+)\s+norm`)
+
+var sizeUnits = map[string]uint64{
+	"":   1,
+	"B":  1,
+	"K":  1 << 10,
+	"KB": 1 << 10,
+	"M":  1 << 20,
+	"MB": 1 << 20,
+	"G":  1 << 30,
+	"GB": 1 << 30,
+	"T":  1 << 40,
+	"TB": 1 << 40,
+	"P":  1 << 50,
+	"PB": 1 << 50,
+}
+
+// ParseSize converts sizes like "63.6GB" to bytes
+func ParseSize(s string) (uint64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := sizeUnits[strings.ToUpper(s[i:])]
+	if !ok || i == 0 {
+		return 0, fmt.Errorf("Unable to parse size %q", s)
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse size %q: %v", s, err)
+	}
+	return uint64(v * float64(unit)), nil
+}
+
+// ParseReplicas extracts the normal number of replicas from a vzsReplicas
+// value, which is either "norm" or "norm:min"
+func ParseReplicas(s string) (int, error) {
+	norm := strings.SplitN(s, ":", 2)[0]
+	n, err := strconv.Atoi(norm)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid number of replicas: %q", s)
+	}
+	return n, nil
+}
+
+// ParseStat parses the "vstorage stat" output. Columns of the chunk
+// server table are located by its header, the TIER column is optional.
+func ParseStat(r io.Reader) (*Stat, error) {
+	st := &Stat{}
+	foundSpace := false
+	var cols map[string]int
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+
+		if m := reSpace.FindStringSubmatch(line); m != nil {
+			var err error
+			if st.Allocatable, err = ParseSize(m[1]); err != nil {
+				return nil, err
+			}
+			if st.Free, err = ParseSize(m[2]); err != nil {
+				return nil, err
+			}
+			if st.Total, err = ParseSize(m[3]); err != nil {
+				return nil, err
+			}
+			foundSpace = true
+			continue
+		}
+
+		if m := reReplication.FindStringSubmatch(line); m != nil {
+			st.Replicas, _ = strconv.Atoi(m[1])
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			cols = nil
+			continue
+		}
+
+		if fields[0] == "CSID" {
+			cols = map[string]int{}
+			for i, f := range fields {
+				cols[f] = i
+			}
+			continue
+		}
+
+		if cols == nil {
+			continue
+		}
+
+		cs, err := parseCSLine(fields, cols)
+		if err != nil {
+			return nil, err
+		}
+		st.CS = append(st.CS, cs)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if !foundSpace {
+		return nil, fmt.Errorf("Unable to find the cluster space in vstorage stat output")
+	}
+
+	return st, nil
+}
+
+func parseCSLine(fields []string, cols map[string]int) (CSStat, error) {
+	cs := CSStat{}
+	field := func(name string) string {
+		i, ok := cols[name]
+		if !ok || i >= len(fields) {
+			return ""
+		}
+		return fields[i]
+	}
+
+	var err error
+	if cs.ID, err = strconv.ParseUint(field("CSID"), 10, 64); err != nil {
+		return cs, fmt.Errorf("Unable to parse CS line %q: %v", strings.Join(fields, " "), err)
+	}
+	cs.Status = field("STATUS")
+	if cs.Space, err = ParseSize(field("SPACE")); err != nil {
+		return cs, err
+	}
+	if cs.Avail, err = ParseSize(field("AVAIL")); err != nil {
+		return cs, err
+	}
+	if t := field("TIER"); t != "" {
+		if cs.Tier, err = strconv.Atoi(t); err != nil {
+			return cs, fmt.Errorf("Unable to parse tier %q: %v", t, err)
+		}
+	}
+	return cs, nil
+}
+
+// Available returns how much data can be written to the cluster or to one
+// of its tiers if tier isn't negative. replicas overrides the default
+// number of replicas of the cluster if it's positive. The allocatable space
+// which the cluster reports already takes the default replication into
+// account, so it's returned as is. Otherwise the space is counted from the
+// raw space of chunk servers, space of chunk servers which aren't active
+// can't be allocated, so it isn't counted.
+func (st *Stat) Available(tier int, replicas int) uint64 {
+	if replicas <= 0 {
+		replicas = st.Replicas
+	}
+	if tier < 0 && (replicas == st.Replicas || len(st.CS) == 0) {
+		return st.Allocatable
+	}
+
+	avail := uint64(0)
+	for _, cs := range st.CS {
+		if (tier < 0 || cs.Tier == tier) && cs.Status == "active" {
+			avail += cs.Avail
+		}
+	}
+	if replicas <= 0 {
+		replicas = 1
+	}
+	return avail / uint64(replicas)
+}
+
+func (v *Vstorage) Stat() (*Stat, error) {
+	stat := exec.Command("vstorage", "-c", v.Name, "stat")
+	out, err := stat.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get stat of %s: %v", v.Name, err)
+	}
+	return ParseStat(strings.NewReader(string(out)))
+}
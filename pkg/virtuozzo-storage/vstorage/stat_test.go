@@ -0,0 +1,110 @@
+package vstorage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const statOutput = `connected to MDS#1
+Cluster 'stor1': healthy
+Space: [OK] allocatable 598GB of 2.5TB, free 1.9TB of 2.5TB
+MDS nodes: 3 of 3, epoch uptime: 10h 25m
+CS nodes:  7 of 7 (6 avail, 0 inactive, 1 offline)
+License: PCSS.02444715.0000 is ACTIVE, 6399TB capacity
+Replication:  3 norm,  2 limit
+Chunks: [OK] 1431 (100%) healthy,  0 (0%) standby,  0 (0%) degraded,  0 (0%) urgent,
+             0 (0%) blocked,  0 (0%) pending,  0 (0%) offline,  0 (0%) replicating,
+             0 (0%) overcommitted,  0 (0%) deleting,  0 (0%) void
+FS:  180GB in 52 files, 52 inodes,  2416 file maps,  1431 chunks,  4293 chunk replicas
+IO:       read     0B/s (  0ops/s), write     0B/s (  0ops/s)
+IO total: read    1.2GB (  9ops), write    180GB ( 1440ops)
+Repl IO:  read     0B/s, write:     0B/s
+Sync rate:   0ops/s, datasync rate:   0ops/s
+
+MDSID STATUS   %CTIME   COMMITS   %CPU    MEM   UPTIME HOST
+M   1 avail      3.1%       1/s   0.1%    14m  10h 25m 10.0.0.1:2510
+    2 avail      2.6%       0/s   0.0%    14m  10h 25m 10.0.0.2:2510
+    3 avail      3.0%       1/s   0.3%    15m  10h 25m 10.0.0.3:2510
+
+ CSID STATUS      SPACE   AVAIL REPLICAS   UNIQUE IOWAIT IOLAT(ms) QDEPTH HOST       TIER
+ 1025 active      200GB   190GB      477        0     0%       0/0    0.0 10.0.0.1      0
+ 1026 active      200GB   190GB      477        0     0%       0/0    0.0 10.0.0.2      0
+ 1027 active      200GB   190GB      477        0     0%       0/0    0.0 10.0.0.3      0
+ 1028 active      500GB   450GB      954        0     0%       0/0    0.0 10.0.0.1      1
+ 1029 active      500GB   450GB      954        0     0%       0/0    0.0 10.0.0.2      1
+ 1030 active      500GB   450GB      954        0     0%       0/0    0.0 10.0.0.3      1
+ 1031 offline     500GB   450GB        0        0     0%       0/0    0.0 10.0.0.4      1
+
+ CLID   LEASES     READ    WRITE     RD_OPS     WR_OPS     FSYNCS IOLAT(ms) HOST
+ 2060      0/0     0B/s     0B/s     0ops/s     0ops/s     0ops/s       0/0 10.0.0.1
+`
+
+func TestParseSize(t *testing.T) {
+	for s, v := range map[string]uint64{
+		"0":      0,
+		"512B":   512,
+		"1KB":    1024,
+		"63.5GB": 63*1024*1024*1024 + 512*1024*1024,
+		"1TB":    1024 * 1024 * 1024 * 1024,
+		"2m":     2 * 1024 * 1024,
+	} {
+		size, err := ParseSize(s)
+		assert.NoError(t, err)
+		assert.Equal(t, v, size, s)
+	}
+
+	for _, s := range []string{"", "GB", "1XB", "1.2.3GB"} {
+		_, err := ParseSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParseReplicas(t *testing.T) {
+	n, err := ParseReplicas("3")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	n, err = ParseReplicas("3:2")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	_, err = ParseReplicas("0")
+	assert.Error(t, err)
+
+	_, err = ParseReplicas("three")
+	assert.Error(t, err)
+}
+
+func TestParseStat(t *testing.T) {
+	st, err := ParseStat(strings.NewReader(statOutput))
+	assert.NoError(t, err)
+	tb := float64(1 << 40)
+	assert.Equal(t, uint64(598)<<30, st.Allocatable)
+	assert.Equal(t, uint64(1.9*tb), st.Free)
+	assert.Equal(t, uint64(2.5*tb), st.Total)
+	assert.Equal(t, 3, st.Replicas)
+	assert.Equal(t, 7, len(st.CS))
+	assert.Equal(t, CSStat{ID: 1028, Status: "active", Tier: 1, Space: 500 << 30, Avail: 450 << 30}, st.CS[3])
+
+	// the allocatable space takes the default replication into account
+	assert.Equal(t, uint64(598)<<30, st.Available(-1, 0))
+	assert.Equal(t, uint64(598)<<30, st.Available(-1, 3))
+	// the raw space of active chunk servers with two replicas
+	assert.Equal(t, (uint64(570+1350)<<30)/2, st.Available(-1, 2))
+	// tier 0 with the default replication and with two replicas
+	assert.Equal(t, uint64(190)<<30, st.Available(0, 0))
+	assert.Equal(t, (uint64(570)<<30)/2, st.Available(0, 2))
+	// offline chunk servers are skipped
+	assert.Equal(t, uint64(450)<<30, st.Available(1, 0))
+	// unknown tier
+	assert.Equal(t, uint64(0), st.Available(2, 0))
+
+	// chunk servers aren't listed
+	st.CS = nil
+	assert.Equal(t, uint64(598)<<30, st.Available(-1, 2))
+
+	_, err = ParseStat(strings.NewReader("Cluster 'stor1': healthy\n"))
+	assert.Error(t, err)
+}
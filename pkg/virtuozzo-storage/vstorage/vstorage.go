@@ -1,78 +1,73 @@
 package vstorage
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
-	"io"
-	"os"
 	"os/exec"
 	"strings"
-	"syscall"
 )
 
-const FUSE_SUPER_MAGIC = 0x65735546
-
 type Vstorage struct {
 	Name string
 }
 
-type Mntent struct {
-	Device string
-	Path   string
-	Type   string
+// CmdError is returned when a vstorage command fails. It keeps stderr of
+// the command to let users know what is wrong with a cluster.
+type CmdError struct {
+	Op     string
+	Name   string
+	Err    error
+	Stderr string
 }
 
-func IsVstorage(path string) (bool, error) {
-	var buf syscall.Statfs_t
-	if err := syscall.Statfs(path, &buf); err != nil {
-		return false, fmt.Errorf("Unable to get filesystem statistics for %s: %v", path, err)
+func (e *CmdError) Error() string {
+	msg := fmt.Sprintf("Unable to %s %s: %v", e.Op, e.Name, e.Err)
+	if e.Stderr != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, e.Stderr)
 	}
-	return buf.Type == FUSE_SUPER_MAGIC, nil
+	return msg
 }
 
-func readMounts(path string) ([]Mntent, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
+// Operations of CmdError
+const (
+	OpAuth   = "authenticate the node in"
+	OpMount  = "mount"
+	OpRevoke = "revoke a lease of"
+)
 
-	out := []Mntent{}
-	r := bufio.NewReader(f)
-	for {
-		line, err := r.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
-		fields := strings.Fields(line)
-		if len(fields) < 3 {
-			continue
-		}
+func newCmdError(op, name string, err error) *CmdError {
+	e := &CmdError{Op: op, Name: name, Err: err}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		e.Stderr = strings.TrimSpace(string(exitErr.Stderr))
+	}
+	return e
+}
 
-		out = append(out, Mntent{
-			Device: fields[0],
-			Path:   fields[1],
-			Type:   fields[2],
-		})
+// IsVstorage reports whether the whole cluster name is mounted in path.
+// Other clusters and bind mounts of cluster subdirectories don't count.
+func IsVstorage(name, path string) (bool, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return false, err
 	}
-	return out, nil
+	m := lookupMount(mounts, path)
+	return m != nil && m.isVstorageMount(name), nil
 }
 
+// Mountpoint returns a path where the cluster is mounted or an empty
+// string if it isn't mounted. Bind mounts of cluster subdirectories are
+// skipped.
 func (v *Vstorage) Mountpoint() (string, error) {
-	// find out cluster mount point
-	mounts, err := readMounts("/proc/mounts")
+	mounts, err := readMountInfo()
 	if err != nil {
-		return "", fmt.Errorf("Unable to parse /proc/mounts: %v", err)
+		return "", err
 	}
-	mount := ""
 	for _, m := range mounts {
-		if m.Type == "fuse.vstorage" && m.Device == "vstorage://"+v.Name {
-			mount = m.Path
-			break
+		if m.isVstorageMount(v.Name) {
+			return m.MountPoint, nil
 		}
 	}
-	return mount, nil
+	return "", nil
 }
 
 func (v *Vstorage) Auth(password string) error {
@@ -82,7 +77,7 @@ func (v *Vstorage) Auth(password string) error {
 	auth.Stdin = &b
 	_, err := auth.Output()
 	if err != nil {
-		return fmt.Errorf("Unable to authenticate the node in %s: %v", v.Name, err)
+		return newCmdError(OpAuth, v.Name, err)
 	}
 	return nil
 }
@@ -91,7 +86,7 @@ func (v *Vstorage) Mount(where string) error {
 	mount := exec.Command("vstorage-mount", "-c", v.Name, where)
 	_, err := mount.Output()
 	if err != nil {
-		return fmt.Errorf("Unable to mount %s in %s: %v", v.Name, where, err)
+		return newCmdError(OpMount, fmt.Sprintf("%s in %s", v.Name, where), err)
 	}
 	return nil
 }
@@ -100,7 +95,7 @@ func (v *Vstorage) Revoke(path string) error {
 	mount := exec.Command("vstorage", "-c", v.Name, "revoke", "-R", path)
 	_, err := mount.Output()
 	if err != nil {
-		return fmt.Errorf("Unable to revoke %s path %s: %v", v.Name, path, err)
+		return newCmdError(OpRevoke, fmt.Sprintf("%s path %s", v.Name, path), err)
 	}
 	return nil
 }